@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func moveFileOrDie(src, dest string) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create path for %s!\n", dest)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := os.Rename(src, dest); err == nil {
+		return
+	}
+
+	// The repo may be on a different filesystem to $HOME
+	info, err := os.Stat(src)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	srcFile, err := os.Open(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open %s!\n", src)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer srcFile.Close()
+	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create file %s!\n", dest)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err = io.Copy(destFile, srcFile); err == nil {
+		err = destFile.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to copy to file %s!\n", dest)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err = os.Remove(src); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to remove %s!\n", src)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Moves a file from $HOME into a layer's files and links it back, the same
+// way linking the overlay would.
+func adoptCommand(path string, layerDir string, homeDir string, relative bool) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !strings.HasPrefix(path, homeDir+"/") {
+		fmt.Fprintf(os.Stderr, "%s is not in %s!\n", path, homeDir)
+		os.Exit(1)
+	}
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		fmt.Fprintf(os.Stderr, "%s is not a regular file!\n", path)
+		os.Exit(1)
+	}
+	dest := layerDir + "/files/" + strings.TrimPrefix(path, homeDir+"/")
+	if _, err := os.Lstat(dest); err == nil {
+		fmt.Fprintf(os.Stderr, "%s is already in the repo!\n", dest)
+		os.Exit(1)
+	}
+
+	moveFileOrDie(path, dest)
+	if err = os.Symlink(linkTarget(dest, path, relative), path); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to link %s to %s\n", dest, path)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
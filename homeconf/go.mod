@@ -1,3 +1,7 @@
 module sysconf.go
 
 go 1.14
+
+require overlay v0.0.0
+
+replace overlay => ../overlay
@@ -5,68 +5,146 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net/http"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"overlay"
 )
 
 var STDOUT io.Writer
 var STDERR io.Writer
 
-func linkDirContents(src string, dest string) {
-	contents, err := ioutil.ReadDir(src)
-	if err != nil {
+// Installs the winning copy of each file in the overlay into dest, linking
+// it unless modes says otherwise.
+func linkOverlay(files map[string]overlay.File, dest string, modes map[string]string, force bool, relative bool) {
+	checksums := readChecksums(dest)
+	for _, path := range overlay.SortedPaths(files) {
+		src := files[path].Src
+		os.MkdirAll(filepath.Dir(dest+path), 0755)
+		switch installMode(files, modes, path) {
+		case installCopy:
+			installCopyFile(src, dest+path, path, checksums, force)
+		case installHardlink:
+			installHardlinkFile(src, dest+path, path, checksums, force)
+		default:
+			linkFile(linkTarget(src, dest+path, relative), dest+path, path)
+		}
+	}
+	writeChecksums(dest, checksums)
+}
+
+// Moves an existing directory out of the way of a link, keeping anything
+// in it.
+func backupOrDie(path string) {
+	backup := path + ".homeconf-backup"
+	if _, err := os.Lstat(backup); err == nil {
+		backup += "-" + time.Now().Format("20060102-150405")
+	}
+	if err := os.Rename(path, backup); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to move %s out of the way!\n", path)
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	fmt.Printf("Moved existing %s to %s\n", path, backup)
+}
 
-	for _, file := range contents {
-		srcFilename := src + "/" + file.Name()
-		destFilename := dest + "/" + file.Name()
+// Returns what a link at destFilename holds to point at srcFilename.
+func linkTarget(srcFilename string, destFilename string, relative bool) string {
+	if !relative {
+		return srcFilename
+	}
+	target, err := filepath.Rel(filepath.Dir(destFilename), srcFilename)
+	if err != nil {
+		return srcFilename
+	}
+	return target
+}
 
-		if file.IsDir() {
-			os.MkdirAll(destFilename, 0755)
-			linkDirContents(srcFilename, destFilename)
-		} else {
-			if destFile, err := os.Lstat(destFilename); err != nil {
-				// File doesn't exist
-				if err = os.Symlink(srcFilename, destFilename); err != nil {
-					fmt.Fprintf(os.Stderr, "Unable to link %s to %s\n", srcFilename, destFilename)
-					fmt.Fprintln(os.Stderr, err)
-					os.Exit(1)
-				}
-			} else {
-				remove := destFile.Mode().IsRegular()
-				if !remove && (destFile.Mode()&os.ModeSymlink != 0) {
-					// Symlink is already there, need to check if it's correct
-					linkDest, err := os.Readlink(destFilename)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "%s is already a link, but it is unreadable!\n", destFilename)
-						fmt.Fprintln(os.Stderr, err)
-						os.Exit(1)
-					}
-					if linkDest != srcFilename {
-						// symlink points somewhere else, remove it
-						remove = true
-					}
-				}
-				if remove {
-					if err = os.Remove(destFilename); err != nil {
-						fmt.Fprintf(os.Stderr, "Unable to link %s to %s; couldn't remove existing file\n", srcFilename, destFilename)
-						fmt.Fprintln(os.Stderr, err)
-						os.Exit(1)
-					}
-					if err = os.Symlink(srcFilename, destFilename); err != nil {
-						fmt.Fprintf(os.Stderr, "Unable to link %s to %s\n", srcFilename, destFilename)
-						fmt.Fprintln(os.Stderr, err)
-						os.Exit(1)
-					}
+// Returns the absolute path a link points at.
+func resolveLink(destFilename string, linkDest string) string {
+	if filepath.IsAbs(linkDest) {
+		return linkDest
+	}
+	return filepath.Join(filepath.Dir(destFilename), linkDest)
+}
+
+// Returns the repo that path is the file rel of, or "" when it isn't in
+// any layer's files.
+func checkoutOf(path string, rel string) string {
+	i := strings.LastIndex(path, "/dotfiles/")
+	if i == -1 {
+		return ""
+	}
+	layerPath := path[i+len("/dotfiles/"):]
+	slash := strings.Index(layerPath, "/")
+	if slash == -1 || layerPath[slash:] != "/files"+rel {
+		return ""
+	}
+	return path[:i]
+}
+
+// Returns the repo a link points into when it is to the same file in
+// another checkout than src, like one that has since moved, or "".  A link
+// into another layer of src's checkout isn't an old checkout.  rel is the
+// file's path under $HOME.
+func oldCheckout(linkDest string, src string, rel string) string {
+	old := checkoutOf(linkDest, rel)
+	if old == checkoutOf(src, rel) {
+		return ""
+	}
+	return old
+}
+
+func linkFile(target string, destFilename string, rel string) {
+	if destFile, err := os.Lstat(destFilename); err != nil {
+		// File doesn't exist
+		if err = os.Symlink(target, destFilename); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to link %s to %s\n", target, destFilename)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else if destFile.IsDir() {
+		backupOrDie(destFilename)
+		if err = os.Symlink(target, destFilename); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to link %s to %s\n", target, destFilename)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else {
+		remove := destFile.Mode().IsRegular()
+		if !remove && (destFile.Mode()&os.ModeSymlink != 0) {
+			// Symlink is already there, need to check if it's correct
+			linkDest, err := os.Readlink(destFilename)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s is already a link, but it is unreadable!\n", destFilename)
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if linkDest != target {
+				// symlink points somewhere else, remove it
+				remove = true
+				old := oldCheckout(resolveLink(destFilename, linkDest), resolveLink(destFilename, target), rel)
+				if old != "" {
+					fmt.Printf("Migrating %s from the checkout at %s\n", destFilename, old)
 				}
 			}
 		}
+		if remove {
+			if err = os.Remove(destFilename); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to link %s to %s; couldn't remove existing file\n", target, destFilename)
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if err = os.Symlink(target, destFilename); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to link %s to %s\n", target, destFilename)
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
 	}
 }
 
@@ -123,58 +201,8 @@ func enableServices(filename string) {
 	}
 }
 
-func downloadFileOrDie(src, dest string) {
-	response, err := http.Get(src)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to download %s!\n", src)
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-
-	if err = os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to create path for %s!\n", dest)
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-
-	destFile, err := os.Create(dest)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to create file %s!\n", dest)
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-
-	_, err = io.Copy(destFile, response.Body)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to copy to file!\n", dest)
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-
-	if err = response.Body.Close(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-	if err = destFile.Close(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
-	}
-}
-
-func fileExists(fullpath string) bool {
-	_, err := os.Stat(fullpath)
-	return err == nil
-}
-
-func setupNeovim(home string) {
-	vimPluggedLocation := home + "/.local/share/nvim/site/autoload/plug.vim"
-	if !fileExists(vimPluggedLocation) {
-		downloadFileOrDie("https://raw.githubusercontent.com/junegunn/vim-plug/master/plug.vim", vimPluggedLocation)
-	}
-
-	runOrDie("nvim", "--headless", "+PlugInstall", "+qall")
-	runOrDie("nvim", "--headless", "+GoInstallBinaries", "+qall")
-}
+// Paths are under $HOME, and directories can be linked as a whole.
+var overlayOptions = overlay.Options{LinkDirs: true, Prefix: "~"}
 
 func main() {
 	if os.Getuid() == 0 {
@@ -184,9 +212,19 @@ func main() {
 
 	var system string
 	var withOutput bool
+	var extraLayers string
+	var force bool
+	var relative bool
+	var repoPath string
+	var onlyTasks string
 
 	flag.StringVar(&system, "system", "", "Optional. The hostname of the system to configure.")
 	flag.BoolVar(&withOutput, "output", false, "Optional. Display the output of the commands run.")
+	flag.StringVar(&extraLayers, "layers", "", "Optional. Comma separated layers to apply between shared and the host instead of the host's roles.")
+	flag.BoolVar(&force, "force", false, "Optional. Overwrite copied files that have been edited locally.")
+	flag.BoolVar(&relative, "relative", false, "Optional. Create relative links, so the home directory and repo can move together.")
+	flag.StringVar(&repoPath, "repo", os.Getenv("HOMECONF_REPO"), "Optional. The config repo to link from, defaults to $HOMECONF_REPO or the one this binary is in.")
+	flag.StringVar(&onlyTasks, "only", "", "Optional. Comma separated tasks to run, even if nothing they depend on changed.")
 	flag.Parse()
 	if system == "" {
 		var err error
@@ -196,12 +234,15 @@ func main() {
 		}
 	}
 
-	exePath, err := os.Executable()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	if repoPath == "" {
+		exePath, err := os.Executable()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		repoPath = filepath.Dir(exePath) + "/.."
 	}
-	srcPath, err := filepath.Abs(filepath.Dir(exePath) + "/../dotfiles")
+	srcPath, err := filepath.Abs(repoPath + "/dotfiles")
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -227,12 +268,52 @@ func main() {
 	}
 	homeDir := user.HomeDir
 
-	linkDirContents(sharedDir+"/files", homeDir)
-	linkDirContents(systemDir+"/files", homeDir)
+	extra, err := overlay.Extra(filepath.Dir(srcPath), system, extraLayers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to find the layers for %s!\n", system)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	layers := overlay.Layers(srcPath, system, extra)
+	only := []string{}
+	if onlyTasks != "" {
+		only = strings.Split(onlyTasks, ",")
+	}
+	files, warnings := overlay.Resolve(layers, "files", overlayOptions)
+	modes := readInstallModes(overlay.Paths(layers, "install"))
+	perms := readPerms(overlay.Paths(layers, "perms"))
+	checkPermsOrDie(perms, files, modes, homeDir)
+
+	switch flag.Arg(0) {
+	case "":
+	case "adopt":
+		path, host := overlay.AdoptArgsOrDie("homeconf", flag.Args()[1:])
+		if host {
+			adoptCommand(path, systemDir, homeDir, relative)
+		} else {
+			adoptCommand(path, sharedDir, homeDir, relative)
+		}
+		return
+	case "status":
+		drift := statusCommand(files, modes, homeDir)
+		if permsStatus(perms, files, modes, homeDir) || drift {
+			os.Exit(1)
+		}
+		return
+	case "layers":
+		overlay.List(layers, files, warnings, overlayOptions)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	overlay.PrintWarnings(warnings)
+	linkOverlay(files, homeDir, modes, force, relative)
+	applyPerms(perms, files, modes, homeDir)
 
-	setupNeovim(homeDir)
-	// Set default gtk font
-	runOrDie("gsettings", "set", "org.gnome.desktop.interface", "font-name", "Noto Sans Regular 10")
+	runTasks(readTasks(overlay.Paths(layers, "tasks")), only, homeDir)
 
 	//enableServices(sharedDir + "/services")
 	//enableServices(systemDir + "/services")
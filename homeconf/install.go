@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"overlay"
+)
+
+// How a file is put in place, set per path in a layer's install file with
+// lines like ".pam_environment copy".  Files not listed are linked.
+const (
+	installLink     = "link"
+	installCopy     = "copy"
+	installHardlink = "hardlink"
+)
+
+// Records the checksum of each copied or hardlinked file as it was
+// installed, relative to $HOME, so local edits can be told apart from
+// changes in the repo.
+const checksumsFile = "/.local/state/homeconf/checksums"
+
+func readInstallModes(installFiles []string) map[string]string {
+	modes := map[string]string{}
+	for _, filename := range installFiles {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read %s!\n", filename)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if len(fields) != 2 || (fields[1] != installLink && fields[1] != installCopy && fields[1] != installHardlink) {
+				fmt.Fprintf(os.Stderr, "Invalid line in %s: %s\n", filename, line)
+				os.Exit(1)
+			}
+			modes["/"+strings.TrimPrefix(fields[0], "/")] = fields[1]
+		}
+	}
+	return modes
+}
+
+// Returns how path is installed.  Linked directories are always linked,
+// whatever the install files say.
+func installMode(files map[string]overlay.File, modes map[string]string, path string) string {
+	if files[path].Dir {
+		return installLink
+	}
+	return modes[path]
+}
+
+func fileChecksum(filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func readChecksums(homeDir string) map[string]string {
+	checksums := map[string]string{}
+	data, err := ioutil.ReadFile(homeDir + checksumsFile)
+	if err != nil {
+		return checksums
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			checksums[fields[1]] = fields[0]
+		}
+	}
+	return checksums
+}
+
+func writeChecksums(homeDir string, checksums map[string]string) {
+	paths := []string{}
+	for path := range checksums {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	content := ""
+	for _, path := range paths {
+		content += checksums[path] + "  " + path + "\n"
+	}
+	filename := homeDir + checksumsFile
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create path for %s!\n", filename)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write %s!\n", filename)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Whether dest is a hardlink to src.  dest isn't followed, so a symlink
+// to src left by linking doesn't count.
+func sameFile(src, dest string) bool {
+	srcInfo, srcErr := os.Stat(src)
+	destInfo, destErr := os.Lstat(dest)
+	return srcErr == nil && destErr == nil && destInfo.Mode().IsRegular() && os.SameFile(srcInfo, destInfo)
+}
+
+func copyFileOrDie(src, dest string) {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read %s!\n", src)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// Replace rather than write through, in case dest is a link
+	os.Remove(dest)
+	if err = ioutil.WriteFile(dest, data, info.Mode().Perm()); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to copy %s to %s\n", src, dest)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Copies src to dest unless dest has been edited since it was last
+// installed, which is only overwritten with force.
+func installCopyFile(src, dest, rel string, checksums map[string]string, force bool) {
+	srcSum := fileChecksum(src)
+	info, err := os.Lstat(dest)
+	if err == nil && info.Mode().IsRegular() {
+		destSum := fileChecksum(dest)
+		if destSum == srcSum {
+			checksums[rel] = srcSum
+			return
+		}
+		if destSum != checksums[rel] && !force {
+			fmt.Fprintf(os.Stderr, "Warning: %s has local edits, not overwriting it without -force\n", dest)
+			return
+		}
+	}
+	copyFileOrDie(src, dest)
+	checksums[rel] = srcSum
+}
+
+// Hardlinks dest to src.  git replaces files rather than writing to them,
+// which breaks the link, so like a copy a separate file is only treated as
+// edited when it differs from what was last installed.  The link is made
+// under a temporary name first so dest is kept if linking fails.
+func installHardlinkFile(src, dest, rel string, checksums map[string]string, force bool) {
+	srcSum := fileChecksum(src)
+	if sameFile(src, dest) {
+		checksums[rel] = srcSum
+		return
+	}
+	info, err := os.Lstat(dest)
+	if err == nil && info.Mode().IsRegular() {
+		destSum := fileChecksum(dest)
+		if destSum != srcSum && destSum != checksums[rel] && !force {
+			fmt.Fprintf(os.Stderr, "Warning: %s has local edits, not overwriting it without -force\n", dest)
+			return
+		}
+	}
+
+	tmp := dest + ".homeconf-tmp"
+	os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to hardlink %s to %s\n", src, dest)
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, syscall.EXDEV) {
+			fmt.Fprintln(os.Stderr, "Hardlinks need the repo on the same filesystem as $HOME.")
+		}
+		os.Exit(1)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		fmt.Fprintf(os.Stderr, "Unable to hardlink %s to %s\n", src, dest)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	checksums[rel] = srcSum
+}
+
+// Checks a copied or hardlinked file, returning a description of the drift
+// or "" if it is as homeconf would leave it.
+func installDrift(src, dest, rel, mode string, checksums map[string]string) string {
+	info, err := os.Lstat(dest)
+	if err != nil {
+		return "missing"
+	}
+	if !info.Mode().IsRegular() {
+		return "not a regular file"
+	}
+	if mode == installHardlink && sameFile(src, dest) {
+		return ""
+	}
+	destSum := fileChecksum(dest)
+	switch {
+	case destSum == fileChecksum(src):
+		if mode == installHardlink {
+			return "not hardlinked to the repo"
+		}
+		return ""
+	case destSum != checksums[rel]:
+		return "edited locally"
+	}
+	return "out of date with the repo"
+}
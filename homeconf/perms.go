@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"overlay"
+)
+
+// Reads the modes from each layer's perms file, lines like
+// "bin/setwinboot 0755", with later layers winning.  A trailing slash, as
+// in ".ssh/ 0700", marks a directory that homeconf creates if it is
+// missing, which is kept as os.ModeDir in its mode.
+func readPerms(permsFiles []string) map[string]os.FileMode {
+	perms := map[string]os.FileMode{}
+	for _, filename := range permsFiles {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read %s!\n", filename)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			mode, err := strconv.ParseUint(fields[len(fields)-1], 8, 32)
+			if len(fields) != 2 || err != nil || mode > 0777 {
+				fmt.Fprintf(os.Stderr, "Invalid line in %s: %s\n", filename, line)
+				os.Exit(1)
+			}
+			path := "/" + strings.Trim(fields[0], "/")
+			perms[path] = os.FileMode(mode)
+			if strings.HasSuffix(fields[0], "/") {
+				perms[path] |= os.ModeDir
+			}
+		}
+	}
+	return perms
+}
+
+// Returns the files whose mode is set for path.  Links take their mode
+// from the source in the repo, copies need it on both.  Paths inside a
+// linked directory are set on the repo source too.  Directories marked with
+// a trailing slash that aren't in the overlay are under $HOME.  Any other
+// path is an error, as it would never be applied.
+func permsTargets(path string, mode os.FileMode, files map[string]overlay.File, modes map[string]string, homeDir string) ([]string, error) {
+	if f, ok := files[path]; ok {
+		if mode.IsDir() && !f.Dir {
+			return nil, fmt.Errorf("~%s is marked as a directory but is a file in %s", path, f.Layer)
+		}
+		if installMode(files, modes, path) == installCopy {
+			return []string{f.Src, homeDir + path}, nil
+		}
+		return []string{f.Src}, nil
+	}
+	if dir := overlay.LinkedParent(files, path); dir != "" {
+		return []string{files[dir].Src + strings.TrimPrefix(path, dir)}, nil
+	}
+	if mode.IsDir() {
+		return []string{homeDir + path}, nil
+	}
+	return nil, fmt.Errorf("~%s is not in the overlay, directories need a trailing slash", path)
+}
+
+// Checks that every path in perms can be applied, so a typo is caught
+// before anything is changed.
+func checkPermsOrDie(perms map[string]os.FileMode, files map[string]overlay.File, modes map[string]string, homeDir string) {
+	for _, path := range sortedModes(perms) {
+		if _, err := permsTargets(path, perms[path], files, modes, homeDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid perms: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func applyPerms(perms map[string]os.FileMode, files map[string]overlay.File, modes map[string]string, homeDir string) {
+	for _, path := range sortedModes(perms) {
+		mode := perms[path]
+		targets, _ := permsTargets(path, mode, files, modes, homeDir)
+		for _, target := range targets {
+			if mode.IsDir() {
+				if err := os.MkdirAll(target, mode.Perm()); err != nil {
+					fmt.Fprintf(os.Stderr, "Unable to create %s!\n", target)
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+			}
+			if err := os.Chmod(target, mode.Perm()); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to set mode of %s!\n", target)
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+func sortedModes(perms map[string]os.FileMode) []string {
+	paths := []string{}
+	for path := range perms {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Prints each file whose mode differs from the declared one, calling out
+// private files that others can read, and returns whether there were any.
+func permsStatus(perms map[string]os.FileMode, files map[string]overlay.File, modes map[string]string, homeDir string) bool {
+	drift := false
+	for _, path := range sortedModes(perms) {
+		want := perms[path].Perm()
+		targets, _ := permsTargets(path, perms[path], files, modes, homeDir)
+		for _, target := range targets {
+			info, err := os.Stat(target)
+			if err != nil {
+				continue
+			}
+			got := info.Mode().Perm()
+			if got == want {
+				continue
+			}
+			drift = true
+			if want&0077 == 0 && got&0077 != 0 {
+				fmt.Printf("%s: private but readable by others, mode %04o, want %04o\n", target, got, want)
+			} else {
+				fmt.Printf("%s: mode %04o, want %04o\n", target, got, want)
+			}
+		}
+	}
+	return drift
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"overlay"
+)
+
+// Checks a single link, returning a description of the drift or "" if it
+// is as homeconf would leave it.  Relative and absolute links to the source
+// are both fine.
+func linkDrift(srcFilename, destFilename, rel string) string {
+	info, err := os.Lstat(destFilename)
+	if err != nil {
+		return "missing"
+	}
+	if info.Mode().IsRegular() {
+		return "replaced by a regular file"
+	}
+	if info.IsDir() {
+		return "directory instead of a link"
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return "not a link"
+	}
+	linkDest, err := os.Readlink(destFilename)
+	if err != nil {
+		return "unreadable link"
+	}
+	if resolved := resolveLink(destFilename, linkDest); resolved != srcFilename {
+		if old := oldCheckout(resolved, srcFilename, rel); old != "" {
+			return "links into the checkout at " + old
+		}
+		if _, err := os.Stat(destFilename); err != nil {
+			return "broken link to " + linkDest
+		}
+		return "links to " + linkDest
+	}
+	return ""
+}
+
+// Prints each file that differs from what homeconf would set up, and
+// returns whether there were any.
+func statusCommand(files map[string]overlay.File, modes map[string]string, homeDir string) bool {
+	checksums := readChecksums(homeDir)
+	drift := false
+	for _, path := range overlay.SortedPaths(files) {
+		src := files[path].Src
+		dest := homeDir + path
+		mode := installMode(files, modes, path)
+		var status string
+		switch mode {
+		case installCopy, installHardlink:
+			status = installDrift(src, dest, path, mode, checksums)
+		default:
+			status = linkDrift(src, dest, path)
+		}
+		if status == "" {
+			continue
+		}
+		drift = true
+		fmt.Printf("%s: %s\n", dest, status)
+		if info, err := os.Lstat(dest); err == nil && info.Mode().IsRegular() {
+			// diff exits non-zero when the files differ
+			cmd := exec.Command("diff", "-u", src, dest)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			cmd.Run()
+		}
+	}
+	return drift
+}
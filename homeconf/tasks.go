@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Records a hash of each task's run lines and changed files from its last
+// successful run, relative to $HOME.
+const tasksStateFile = "/.local/state/homeconf/tasks"
+
+// Setup to run after linking, declared in a layer's tasks file:
+//
+//	[fontconfig]
+//	requires = fc-cache
+//	changed = .config/fontconfig
+//	run = fc-cache -f
+//
+// A task runs the first time, then again whenever its run lines or a file
+// or directory listed in changed differ from its last run.  Tasks whose
+// required binary is missing are skipped, unless named with -only.  A
+// later layer's task replaces an earlier one with the same name.
+type task struct {
+	name     string
+	requires []string
+	changed  []string
+	run      []string
+}
+
+func readTasks(tasksFiles []string) []task {
+	tasks := []task{}
+	index := map[string]int{}
+	for _, filename := range tasksFiles {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read %s!\n", filename)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		var current *task
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				name := line[1 : len(line)-1]
+				if i, ok := index[name]; ok {
+					tasks[i] = task{name: name}
+				} else {
+					index[name] = len(tasks)
+					tasks = append(tasks, task{name: name})
+				}
+				current = &tasks[index[name]]
+				continue
+			}
+
+			eq := strings.Index(line, "=")
+			if current == nil || eq == -1 {
+				fmt.Fprintf(os.Stderr, "Invalid line in %s: %s\n", filename, line)
+				os.Exit(1)
+			}
+			value := strings.TrimSpace(line[eq+1:])
+			switch strings.TrimSpace(line[:eq]) {
+			case "requires":
+				current.requires = append(current.requires, value)
+			case "changed":
+				current.changed = append(current.changed, value)
+			case "run":
+				current.run = append(current.run, value)
+			default:
+				fmt.Fprintf(os.Stderr, "Invalid line in %s: %s\n", filename, line)
+				os.Exit(1)
+			}
+		}
+	}
+	return tasks
+}
+
+// Hashes the task's run lines and the contents of its changed files,
+// following links into the repo.
+func changedHash(t task, homeDir string) string {
+	hash := sha256.New()
+	for _, command := range t.run {
+		fmt.Fprintf(hash, "run %s\n", command)
+	}
+	for _, changed := range t.changed {
+		root, err := filepath.EvalSymlinks(homeDir + "/" + changed)
+		if err != nil {
+			continue
+		}
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			if data, err := ioutil.ReadFile(path); err == nil {
+				fmt.Fprintf(hash, "%s%s\n%s\n", changed, strings.TrimPrefix(path, root), data)
+			}
+			return nil
+		})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func readTaskState(homeDir string) map[string]string {
+	state := map[string]string{}
+	data, err := ioutil.ReadFile(homeDir + tasksStateFile)
+	if err != nil {
+		return state
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			state[fields[0]] = fields[1]
+		}
+	}
+	return state
+}
+
+func writeTaskState(homeDir string, state map[string]string) {
+	names := []string{}
+	for name := range state {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	content := ""
+	for _, name := range names {
+		content += name + " " + state[name] + "\n"
+	}
+	filename := homeDir + tasksStateFile
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create path for %s!\n", filename)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write %s!\n", filename)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func hasRequirements(t task) bool {
+	for _, binary := range t.requires {
+		if _, err := exec.LookPath(binary); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Runs the tasks whose conditions are met, or only the named ones, which
+// run regardless of their changed files.
+func runTasks(tasks []task, only []string, homeDir string) {
+	known := map[string]bool{}
+	for _, t := range tasks {
+		known[t.name] = true
+	}
+	selected := map[string]bool{}
+	for _, name := range only {
+		if !known[name] {
+			fmt.Fprintf(os.Stderr, "Unknown task %s\n", name)
+			os.Exit(1)
+		}
+		selected[name] = true
+	}
+
+	state := readTaskState(homeDir)
+	for _, t := range tasks {
+		if len(only) != 0 && !selected[t.name] {
+			continue
+		}
+		if !hasRequirements(t) {
+			if selected[t.name] {
+				fmt.Fprintf(os.Stderr, "Unable to run task %s, missing %s\n", t.name, strings.Join(t.requires, ", "))
+				writeTaskState(homeDir, state)
+				os.Exit(1)
+			}
+			fmt.Printf("Skipping task %s, missing %s\n", t.name, strings.Join(t.requires, ", "))
+			continue
+		}
+		hash := changedHash(t, homeDir)
+		if len(only) == 0 && state[t.name] == hash {
+			continue
+		}
+
+		fmt.Printf("Running task %s\n", t.name)
+		for _, command := range t.run {
+			cmd := exec.Command("sh", "-c", command)
+			cmd.Dir = homeDir
+			cmd.Stdout = STDOUT
+			cmd.Stderr = STDERR
+			if err := cmd.Run(); err != nil {
+				fmt.Fprintf(os.Stderr, "Task %s failed running: %s\n", t.name, command)
+				fmt.Fprintln(os.Stderr, err)
+				writeTaskState(homeDir, state)
+				os.Exit(1)
+			}
+		}
+		state[t.name] = hash
+	}
+	writeTaskState(homeDir, state)
+}
@@ -0,0 +1,234 @@
+// Package overlay resolves the layers of config under dotfiles and sysfiles
+// the same way for homeconf and sysconf.  A layer is shared, a role or a
+// host, and a file in a later layer replaces the same file from an earlier
+// one.  It also holds the offline pacman.conf that setup and sysconf share.
+package overlay
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A directory of config under dotfiles or sysfiles.
+type Layer struct {
+	Name string
+	Dir  string
+}
+
+// Returns the layers for system: shared, then any extra layers such as
+// roles, then the host itself so that host specific config always wins.
+func Layers(srcPath string, system string, extra []string) []Layer {
+	layers := []Layer{{"shared", srcPath + "/shared"}}
+	for _, name := range extra {
+		layers = append(layers, Layer{name, srcPath + "/" + name})
+	}
+	return append(layers, Layer{system, srcPath + "/" + system})
+}
+
+// Returns the roles declared for system in the hosts file, from lines like
+// "razerbook laptop".  A missing hosts file means no roles.
+func readRoles(hostsFile string, system string) ([]string, error) {
+	data, err := ioutil.ReadFile(hostsFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 0 && !strings.HasPrefix(line, "#") && fields[0] == system {
+			return fields[1:], nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns the layers to apply between shared and system in repo: the
+// comma separated names when given, as with -layers, otherwise the roles
+// from the hosts file.  Extra layers only need to exist in one of dotfiles
+// and sysfiles.
+func Extra(repo string, system string, names string) ([]string, error) {
+	extra, err := readRoles(repo+"/hosts", system)
+	if err != nil {
+		return nil, err
+	}
+	if names != "" {
+		extra = strings.Split(names, ",")
+	}
+	for _, name := range extra {
+		_, dotfilesErr := os.Stat(repo + "/dotfiles/" + name)
+		_, sysfilesErr := os.Stat(repo + "/sysfiles/" + name)
+		if dotfilesErr != nil && sysfilesErr != nil {
+			return nil, fmt.Errorf("unable to find layer %s", name)
+		}
+	}
+	return extra, nil
+}
+
+// Returns the path of sub in each layer that has it, in layer order.
+func Paths(layers []Layer, sub string) []string {
+	paths := []string{}
+	for _, l := range layers {
+		if _, err := os.Stat(l.Dir + "/" + sub); err == nil {
+			paths = append(paths, l.Dir+"/"+sub)
+		}
+	}
+	return paths
+}
+
+// Marks a directory to be linked as a whole, so files the program creates
+// in it end up in the repo.
+const LinkDirMarker = ".link-dir"
+
+// The winning copy of a file in the overlay.
+type File struct {
+	Src   string
+	Layer string
+	// Earlier layers that have the same file
+	Overrides []string
+	// A directory with a marker, linked as a whole
+	Dir bool
+}
+
+// How files are resolved and shown.
+type Options struct {
+	// Treat directories with LinkDirMarker as a single file
+	LinkDirs bool
+	// Skip anything that isn't a regular file, like links
+	RegularOnly bool
+	// Shown before each path, like "~" for paths under $HOME
+	Prefix string
+}
+
+// Returns the linked directory that rel is inside, if any.
+func LinkedParent(files map[string]File, rel string) string {
+	for dir := filepath.Dir(rel); dir != "/"; dir = filepath.Dir(dir) {
+		if f, ok := files[dir]; ok && f.Dir {
+			return dir
+		}
+	}
+	return ""
+}
+
+// Resolves the files under sub in every layer to the copy that wins for
+// each path.  Warns about files that shadow the same file in an earlier
+// layer, and about files that clash with a directory in another layer or
+// are hidden by a linked directory, since they would be lost.
+func Resolve(layers []Layer, sub string, opts Options) (map[string]File, []string) {
+	files := map[string]File{}
+	dirs := map[string]string{}
+	warnings := []string{}
+	for _, l := range layers {
+		root := l.Dir + "/" + sub
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || path == root {
+				return nil
+			}
+			rel := strings.TrimPrefix(path, root)
+			if dir := LinkedParent(files, rel); dir != "" {
+				warnings = append(warnings, fmt.Sprintf("%s%s: in %s is hidden by the linked directory from %s", opts.Prefix, rel, l.Name, files[dir].Layer))
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				if _, err := os.Stat(path + "/" + LinkDirMarker); !opts.LinkDirs || err != nil {
+					if _, ok := dirs[rel]; !ok {
+						dirs[rel] = l.Name
+					}
+					return nil
+				}
+				// Replaces whatever earlier layers had inside it
+				for other := range files {
+					if strings.HasPrefix(other, rel+"/") {
+						delete(files, other)
+					}
+				}
+			} else if opts.RegularOnly && !info.Mode().IsRegular() {
+				return nil
+			}
+			f := File{path, l.Name, nil, info.IsDir()}
+			if prev, ok := files[rel]; ok {
+				f.Overrides = append(prev.Overrides, prev.Layer)
+			}
+			files[rel] = f
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+	}
+
+	for rel, f := range files {
+		if dirLayer, ok := dirs[rel]; ok && !f.Dir {
+			warnings = append(warnings, fmt.Sprintf("%s%s: file in %s clashes with directory in %s", opts.Prefix, rel, f.Layer, dirLayer))
+		}
+		if len(f.Overrides) != 0 {
+			warnings = append(warnings, fmt.Sprintf("%s%s: %s shadows %s", opts.Prefix, rel, f.Layer, strings.Join(f.Overrides, ", ")))
+		}
+	}
+	sort.Strings(warnings)
+	return files, warnings
+}
+
+func SortedPaths(files map[string]File) []string {
+	paths := []string{}
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func PrintWarnings(warnings []string) {
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "Warning: "+warning)
+	}
+}
+
+// Prints the layer each file comes from.
+func List(layers []Layer, files map[string]File, warnings []string, opts Options) {
+	names := []string{}
+	for _, l := range layers {
+		names = append(names, l.Name)
+	}
+	fmt.Println("Layers: " + strings.Join(names, " -> "))
+
+	for _, path := range SortedPaths(files) {
+		f := files[path]
+		line := opts.Prefix + path
+		if f.Dir {
+			line += "/"
+		}
+		line += " " + f.Layer
+		if len(f.Overrides) != 0 {
+			line += " (overrides " + strings.Join(f.Overrides, ", ") + ")"
+		}
+		fmt.Println(line)
+	}
+	PrintWarnings(warnings)
+}
+
+// Parses the arguments after adopt, "<path> [-host]", allowing the flag on
+// either side of the path.  Returns the path and whether to adopt into the
+// host's layer instead of shared.
+func AdoptArgsOrDie(tool string, args []string) (string, bool) {
+	adoptFlags := flag.NewFlagSet("adopt", flag.ExitOnError)
+	host := adoptFlags.Bool("host", false, "Optional. Adopt into the host's files instead of shared.")
+	adoptFlags.Parse(args)
+	path := adoptFlags.Arg(0)
+	if path != "" {
+		adoptFlags.Parse(adoptFlags.Args()[1:])
+	}
+	if path == "" || adoptFlags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s adopt <path> [-host]\n", tool)
+		os.Exit(1)
+	}
+	return path, *host
+}
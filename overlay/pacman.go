@@ -0,0 +1,16 @@
+package overlay
+
+// Repo name used by 'sysconf cache-export' and the offline pacman.conf.
+const OfflineRepo = "offline"
+
+// Returns a pacman.conf that installs only from the local repo in repoDir.
+// The packages keep the signatures they were downloaded with, but the
+// database made by repo-add is unsigned.
+func OfflinePacmanConf(repoDir string) string {
+	conf := "[options]\n"
+	conf += "Architecture = auto\n"
+	conf += "SigLevel = Required DatabaseOptional\n\n"
+	conf += "[" + OfflineRepo + "]\n"
+	conf += "Server = file://" + repoDir + "\n"
+	return conf
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type checkResult struct {
+	check   string
+	success bool
+	msg     string
+}
+
+type check struct {
+	run func(p profile, o options) checkResult
+	// Checks that a resumed install is expected to fail
+	freshOnly bool
+}
+
+var checks = []check{
+	{checkIsRoot, false},
+	{checkUefi, false},
+	{checkTools, false},
+	{checkNetwork, false},
+	{checkClock, false},
+	{checkMnt, true},
+	{checkInstallDisks, false},
+	{checkInstallDisksForPartitions, true},
+	{checkInstallDisksNotInUse, true},
+	{checkInstallDisksSize, false},
+	{checkLocalisation, false},
+	{checkSysconfBinary, false},
+	{checkPkgSource, false},
+}
+
+// Runs every check, printing the results, and returns whether they all
+// passed.
+func runChecks(p profile, o options) bool {
+	failures := 0
+	for _, c := range checks {
+		if o.resume && c.freshOnly {
+			continue
+		}
+		res := c.run(p, o)
+		fmt.Print(res.check)
+		fmt.Print("...")
+		if res.success {
+			printSuccess(res.msg, true)
+		} else {
+			printFailure(res.msg, true)
+			failures++
+		}
+	}
+	return failures == 0
+}
+
+func checkIsRoot(p profile, o options) checkResult {
+	check := "Checking root user"
+	msg := "Must be run as root user!"
+	success := os.Getuid() == 0
+	if success {
+		msg = "OK"
+	}
+	return checkResult{check, success, msg}
+}
+
+func checkUefi(p profile, o options) checkResult {
+	check := "Checking booted in UEFI mode"
+	if _, err := os.Stat("/sys/firmware/efi"); err != nil {
+		return checkResult{check, false, "Booted in BIOS mode! Enable UEFI boot in the firmware settings and reboot the installer."}
+	}
+	return checkResult{check, true, "OK"}
+}
+
+func checkTools(p profile, o options) checkResult {
+	check := "Checking required tools"
+	tools := []string{"parted", "mkfs.fat", "mkfs.btrfs", "btrfs", "lsblk", "pacstrap", "arch-chroot"}
+	missing := []string{}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) != 0 {
+		return checkResult{check, false, fmt.Sprintf("Missing %s! Run from the Arch install media or install them.", strings.Join(missing, ", "))}
+	}
+	return checkResult{check, true, "OK"}
+}
+
+func checkNetwork(p profile, o options) checkResult {
+	check := "Checking network"
+	if offline(o) {
+		return checkResult{check, true, "Skipped, installing offline"}
+	}
+	conn, err := net.DialTimeout("tcp", "archlinux.org:443", 10*time.Second)
+	if err != nil {
+		return checkResult{check, false, "Unable to reach archlinux.org! Connect to a network (e.g. with iwctl) and try again."}
+	}
+	conn.Close()
+	return checkResult{check, true, "OK"}
+}
+
+func checkClock(p profile, o options) checkResult {
+	check := "Checking clock is synchronised"
+	if offline(o) {
+		return checkResult{check, true, "Skipped, installing offline"}
+	}
+	out, err := exec.Command("timedatectl", "show", "-p", "NTPSynchronized", "--value").Output()
+	if err != nil {
+		return checkResult{check, false, "Unable to run timedatectl!"}
+	}
+	if strings.TrimSpace(string(out)) != "yes" {
+		return checkResult{check, false, "Clock not synchronised! Run 'timedatectl set-ntp true' and wait, package signatures may fail to verify."}
+	}
+	return checkResult{check, true, "OK"}
+}
+
+func checkMnt(p profile, o options) checkResult {
+	check := "Checking /mnt is free"
+	mounts, err := readMounts()
+	if err != nil {
+		return checkResult{check, false, "Unable to read mounts!"}
+	}
+	for _, m := range mounts {
+		if m.mountpoint == "/mnt" || strings.HasPrefix(m.mountpoint, "/mnt/") {
+			return checkResult{check, false, fmt.Sprintf("%s is mounted on %s! Unmount it with 'umount -R /mnt'.", m.device, m.mountpoint)}
+		}
+	}
+	files, err := ioutil.ReadDir("/mnt")
+	if err != nil && !os.IsNotExist(err) {
+		return checkResult{check, false, "Error reading /mnt!"}
+	}
+	if len(files) != 0 {
+		return checkResult{check, false, "/mnt is not empty! Move its contents somewhere else."}
+	}
+	return checkResult{check, true, "OK"}
+}
+
+func checkInstallDisks(p profile, o options) checkResult {
+	check := "Checking devices exist"
+	for _, disk := range o.disks {
+		_, err := os.Stat("/sys/block/" + disk)
+		if err != nil {
+			msg := fmt.Sprintf("%s does not exist or is not a disk", disk)
+			return checkResult{check, false, msg}
+		}
+	}
+	return checkResult{check, true, "OK"}
+}
+
+func diskPartitions(disk string) ([]string, error) {
+	dir := fmt.Sprintf("/sys/block/%s", disk)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	partitions := []string{}
+	for _, file := range files {
+		if file.IsDir() {
+			_, err := os.Stat(fmt.Sprintf("%s/%s/partition", dir, file.Name()))
+			if err == nil {
+				partitions = append(partitions, file.Name())
+			}
+		}
+	}
+	return partitions, nil
+}
+
+func checkInstallDisksForPartitions(p profile, o options) checkResult {
+	check := "Checking install device for partitions"
+	for _, disk := range o.disks {
+		partitions, err := diskPartitions(disk)
+		if err != nil {
+			return checkResult{check, false, fmt.Sprintf("Error reading /sys/block/%s!", disk)}
+		}
+		if len(partitions) != 0 {
+			return checkResult{check, false, fmt.Sprintf("Found %d partitions on %s! Remove them with 'wipefs -a /dev/%s' if the disk can be wiped.", len(partitions), disk, disk)}
+		}
+	}
+	return checkResult{check, true, "OK"}
+}
+
+func readSwaps() ([]string, error) {
+	file, err := os.Open("/proc/swaps")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	swaps := []string{}
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // Skip the header
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) != 0 {
+			swaps = append(swaps, fields[0])
+		}
+	}
+	return swaps, nil
+}
+
+// Whether device is disk or one of its partitions.  Partitions of disks
+// whose names end in a digit, like nvme0n1 and mmcblk0, have a p before
+// the number, so sda doesn't match sdab and nvme0n1 doesn't match nvme0n11.
+func onDisk(device string, disk string) bool {
+	dev := "/dev/" + disk
+	if device == dev {
+		return true
+	}
+	if !strings.HasPrefix(device, dev) {
+		return false
+	}
+	part := strings.TrimPrefix(device, dev)
+	if last := disk[len(disk)-1]; last >= '0' && last <= '9' {
+		if !strings.HasPrefix(part, "p") {
+			return false
+		}
+		part = part[1:]
+	}
+	if part == "" {
+		return false
+	}
+	for _, c := range part {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func checkInstallDisksNotInUse(p profile, o options) checkResult {
+	check := "Checking install device is not in use"
+	mounts, err := readMounts()
+	if err != nil {
+		return checkResult{check, false, "Unable to read mounts!"}
+	}
+	swaps, err := readSwaps()
+	if err != nil {
+		return checkResult{check, false, "Unable to read /proc/swaps!"}
+	}
+
+	for _, disk := range o.disks {
+		for _, m := range mounts {
+			if onDisk(m.device, disk) {
+				return checkResult{check, false, fmt.Sprintf("%s is mounted on %s! Unmount it first.", m.device, m.mountpoint)}
+			}
+		}
+		for _, swap := range swaps {
+			if onDisk(swap, disk) {
+				return checkResult{check, false, fmt.Sprintf("%s is in use as swap! Run 'swapoff %s' first.", swap, swap)}
+			}
+		}
+		// Device mapper, LVM and RAID devices show up as holders
+		holders, _ := ioutil.ReadDir("/sys/block/" + disk + "/holders")
+		if len(holders) != 0 {
+			return checkResult{check, false, fmt.Sprintf("%s is in use by %s! Close or stop it first.", disk, holders[0].Name())}
+		}
+	}
+	return checkResult{check, true, "OK"}
+}
+
+func diskSize(disk string) (uint64, error) {
+	// Always in 512 byte sectors, whatever the disk's block size
+	data, err := ioutil.ReadFile("/sys/block/" + disk + "/size")
+	if err != nil {
+		return 0, err
+	}
+	sectors, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return sectors * 512, err
+}
+
+func checkInstallDisksSize(p profile, o options) checkResult {
+	check := "Checking install device size"
+	for _, disk := range o.disks {
+		size, err := diskSize(disk)
+		if err != nil {
+			return checkResult{check, false, fmt.Sprintf("Unable to read size of %s!", disk)}
+		}
+		if size < p.minDiskSize<<30 {
+			return checkResult{check, false, fmt.Sprintf("%s is %dGiB, %s needs at least %dGiB! Choose a larger disk.", disk, size>>30, p.hostname, p.minDiskSize)}
+		}
+	}
+	return checkResult{check, true, "OK"}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Everything mounted by this run, in mount order, so that it can be
+// unmounted in reverse on failure, interrupt or completion.  Guarded by
+// mountedLock as the interrupt handler cleans up from its own goroutine.
+var mounted []mount
+var mountedLock sync.Mutex
+var cleanupOnce sync.Once
+
+// The terminal settings from before echo was turned off for a password, so
+// that they are restored if setup exits while one is being typed.
+var savedTermios *unix.Termios
+var termiosLock sync.Mutex
+
+func saveTerminal(termios *unix.Termios) {
+	termiosLock.Lock()
+	defer termiosLock.Unlock()
+	savedTermios = termios
+}
+
+func restoreTerminal() {
+	termiosLock.Lock()
+	defer termiosLock.Unlock()
+	if savedTermios != nil {
+		unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TCSETS, savedTermios)
+		savedTermios = nil
+	}
+}
+
+func trackMount(device, mountpoint string) {
+	mountedLock.Lock()
+	defer mountedLock.Unlock()
+	mounted = append(mounted, mount{device, mountpoint})
+}
+
+func untrackMount(mountpoint string) {
+	mountedLock.Lock()
+	defer mountedLock.Unlock()
+	for i := len(mounted) - 1; i >= 0; i-- {
+		if mounted[i].mountpoint == mountpoint {
+			mounted = append(mounted[:i], mounted[i+1:]...)
+			return
+		}
+	}
+}
+
+// Returns the name of the LUKS mapping behind device, if it is one.
+func cryptMapping(device string) string {
+	if !strings.HasPrefix(device, "/dev/mapper/") {
+		return ""
+	}
+	dm, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return ""
+	}
+	uuid, err := ioutil.ReadFile("/sys/block/" + filepath.Base(dm) + "/dm/uuid")
+	if err != nil || !strings.HasPrefix(string(uuid), "CRYPT-") {
+		return ""
+	}
+	return strings.TrimPrefix(device, "/dev/mapper/")
+}
+
+// Unmounts mounts in reverse order, then closes any LUKS mappings they were
+// on.  Carries on past failures so as much as possible is torn down.
+func unwind(mounts []mount) bool {
+	ok := true
+	mappings := []string{}
+	for i := len(mounts) - 1; i >= 0; i-- {
+		m := mounts[i]
+		if err := unix.Unmount(m.mountpoint, 0); err != nil {
+			printFailure(fmt.Sprintf("Unable to unmount %s!", m.mountpoint), true)
+			fmt.Println(err)
+			ok = false
+			continue
+		}
+		if name := cryptMapping(m.device); name != "" {
+			mappings = append(mappings, name)
+		}
+	}
+
+	closed := map[string]bool{}
+	for _, name := range mappings {
+		if closed[name] {
+			continue
+		}
+		closed[name] = true
+		if err := exec.Command("cryptsetup", "close", name).Run(); err != nil {
+			printFailure(fmt.Sprintf("Unable to close %s!", name), true)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func cleanup() {
+	cleanupOnce.Do(func() {
+		mountedLock.Lock()
+		defer mountedLock.Unlock()
+		if len(mounted) == 0 {
+			return
+		}
+		fmt.Print("Unmounting install...")
+		if unwind(mounted) {
+			printSuccess("OK", true)
+		}
+		mounted = nil
+	})
+}
+
+// Exits after tearing down everything this run set up.
+func die() {
+	restoreTerminal()
+	cleanup()
+	os.Exit(1)
+}
+
+func cleanupOnInterrupt() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Println()
+		printFailure("Interrupted!", true)
+		die()
+	}()
+}
+
+// Returns what is mounted for the install under /mnt, in mount order.
+func installMounts() []mount {
+	mounts, err := readMounts()
+	if err != nil {
+		printFailure("Unable to read mounts!", true)
+		die()
+	}
+
+	install := []mount{}
+	for _, m := range mounts {
+		if m.mountpoint == "/mnt" || strings.HasPrefix(m.mountpoint, "/mnt/") {
+			install = append(install, m)
+		}
+	}
+	return install
+}
+
+// Takes over the mounts a previous run left under /mnt when resuming, so
+// they are unmounted even if the steps that mounted them are skipped.
+func trackPreviousMounts() {
+	for _, m := range installMounts() {
+		trackMount(m.device, m.mountpoint)
+	}
+}
+
+// Tears down a half-finished install left by a previous run, using the
+// mount table rather than what this run mounted.
+func cleanupPrevious() {
+	install := installMounts()
+
+	fmt.Print("Unmounting previous install...")
+	if !unwind(install) {
+		os.Exit(1)
+	}
+	printSuccess("OK", true)
+}
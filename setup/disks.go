@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Block devices that are never install targets
+var ignoredDisks = []string{"loop", "ram", "zram", "sr", "fd", "dm-", "md"}
+
+func sysBlockAttr(disk, attr string) string {
+	data, err := ioutil.ReadFile("/sys/block/" + disk + "/" + attr)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func diskModel(disk string) string {
+	if model := sysBlockAttr(disk, "device/model"); model != "" {
+		return model
+	}
+	return "Unknown model"
+}
+
+func formatSize(bytes uint64) string {
+	if bytes >= 1<<40 {
+		return fmt.Sprintf("%.1fTiB", float64(bytes)/(1<<40))
+	}
+	return fmt.Sprintf("%.1fGiB", float64(bytes)/(1<<30))
+}
+
+func describeDisk(disk string) string {
+	size, err := diskSize(disk)
+	if err != nil {
+		return fmt.Sprintf("/dev/%s %s", disk, diskModel(disk))
+	}
+	return fmt.Sprintf("/dev/%s %s %s", disk, diskModel(disk), formatSize(size))
+}
+
+func lsblkDiskField(dev, field string) string {
+	out, err := exec.Command("lsblk", "-d", "-n", "-o", field, dev).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func candidateDisks() []string {
+	files, err := ioutil.ReadDir("/sys/block")
+	if err != nil {
+		printFailure("Unable to read /sys/block!", true)
+		die()
+	}
+
+	disks := []string{}
+	for _, file := range files {
+		ignored := false
+		for _, prefix := range ignoredDisks {
+			if strings.HasPrefix(file.Name(), prefix) {
+				ignored = true
+			}
+		}
+		if size, err := diskSize(file.Name()); ignored || err != nil || size == 0 {
+			continue
+		}
+		disks = append(disks, file.Name())
+	}
+	return disks
+}
+
+func printDiskDetails(num int, disk string) {
+	transport := lsblkDiskField("/dev/"+disk, "TRAN")
+	if transport == "" {
+		transport = "unknown transport"
+	}
+	removable := ""
+	if sysBlockAttr(disk, "removable") == "1" {
+		removable = ", removable"
+	}
+	fmt.Printf("%d) %s (%s%s)\n", num, describeDisk(disk), transport, removable)
+
+	partitions, _ := diskPartitions(disk)
+	for _, part := range partitions {
+		dev := "/dev/" + part
+		fstype := lsblkDiskField(dev, "FSTYPE")
+		if fstype == "" {
+			fstype = "no filesystem"
+		}
+		label := lsblkDiskField(dev, "LABEL")
+		size, _ := strconv.ParseUint(sysBlockAttr(disk, part+"/size"), 10, 64)
+		fmt.Printf("       %s %s %s %s\n", dev, formatSize(size*512), fstype, label)
+	}
+}
+
+// Lists the disks that could be installed to and asks for count of them,
+// in the order they are to be used.
+func pickDisks(count int) []string {
+	candidates := candidateDisks()
+	if len(candidates) == 0 {
+		printFailure("No disks found!", true)
+		die()
+	}
+
+	fmt.Println("Available disks:")
+	for i, disk := range candidates {
+		printDiskDetails(i+1, disk)
+	}
+
+	disks := []string{}
+	for len(disks) < count {
+		fmt.Printf("Disk %d of %d [1-%d]: ", len(disks)+1, count, len(candidates))
+		num, err := strconv.Atoi(strings.TrimSpace(readLine()))
+		if err != nil || num < 1 || num > len(candidates) {
+			printFailure("Invalid choice!", true)
+			continue
+		}
+		disk := candidates[num-1]
+		chosen := false
+		for _, d := range disks {
+			chosen = chosen || d == disk
+		}
+		if chosen {
+			printFailure(fmt.Sprintf("%s already chosen!", disk), true)
+			continue
+		}
+		disks = append(disks, disk)
+	}
+	return disks
+}
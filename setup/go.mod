@@ -2,4 +2,9 @@ module setup
 
 go 1.14
 
-require golang.org/x/sys v0.0.0-20201201145000-ef89a241ccb3
+require (
+	golang.org/x/sys v0.0.0-20201201145000-ef89a241ccb3
+	overlay v0.0.0
+)
+
+replace overlay => ../overlay
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"overlay"
+)
+
+func writeFileOrDie(filename, content string) {
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		printFailure(fmt.Sprintf("Unable to write %s!", filename), true)
+		fmt.Println(err)
+		die()
+	}
+}
+
+// Points /etc/localtime at the zone the same way timedatectl does.
+func setTimezone(timezone string) {
+	os.Remove("/mnt/etc/localtime")
+	if err := os.Symlink("../usr/share/zoneinfo/"+timezone, "/mnt/etc/localtime"); err != nil {
+		printFailure("Unable to link /etc/localtime!", true)
+		fmt.Println(err)
+		die()
+	}
+	runOrDie("arch-chroot", "/mnt", "hwclock", "--systohc")
+}
+
+// locale.gen is left to sysconf, which enables the locales listed in each
+// layer's sysfiles, so only LANG is set here.
+func setLang(p profile) {
+	writeFileOrDie("/mnt/etc/locale.conf", "LANG="+p.lang+"\n")
+}
+
+// Returns the locales sysconf will enable for system.
+func repoLocales(repo string, system string) ([]string, error) {
+	extra, err := overlay.Extra(repo, system, "")
+	if err != nil {
+		return nil, err
+	}
+	locales := []string{}
+	for _, filename := range overlay.Paths(overlay.Layers(repo+"/sysfiles", system, extra), "locales") {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				locales = append(locales, line)
+			}
+		}
+	}
+	return locales, nil
+}
+
+func setKeymap(p profile) {
+	writeFileOrDie("/mnt/etc/vconsole.conf", "KEYMAP="+p.keymap+"\n")
+}
+
+func setHostname(p profile) {
+	writeFileOrDie("/mnt/etc/hostname", p.hostname+"\n")
+	hosts := "127.0.0.1\tlocalhost\n"
+	hosts += "::1\t\tlocalhost\n"
+	hosts += fmt.Sprintf("127.0.1.1\t%s.localdomain\t%s\n", p.hostname, p.hostname)
+	writeFileOrDie("/mnt/etc/hosts", hosts)
+}
+
+// Checked against the install media, which has the same zoneinfo, locales
+// and keymaps as the installed system.
+func checkLocalisation(p profile, o options) checkResult {
+	check := "Checking timezone, locales and keymap"
+	if !fileExists("/usr/share/zoneinfo/" + p.timezone) {
+		return checkResult{check, false, fmt.Sprintf("Unknown timezone %s! See 'timedatectl list-timezones'.", p.timezone)}
+	}
+
+	supported, err := ioutil.ReadFile("/usr/share/i18n/SUPPORTED")
+	if err != nil {
+		return checkResult{check, false, "Unable to read /usr/share/i18n/SUPPORTED!"}
+	}
+	available := map[string]bool{}
+	// LANG is just the name, like "en_GB.UTF-8"
+	langs := map[string]bool{}
+	for _, line := range strings.Split(string(supported), "\n") {
+		line = strings.TrimSpace(line)
+		available[line] = true
+		if fields := strings.Fields(line); len(fields) != 0 {
+			langs[fields[0]] = true
+		}
+	}
+	if !langs[p.lang] {
+		return checkResult{check, false, fmt.Sprintf("Unknown LANG %s! See /usr/share/i18n/SUPPORTED.", p.lang)}
+	}
+
+	// A cloned repo is only available after cloning
+	if o.repoUrl == "" {
+		repo, err := localRepo()
+		if err != nil {
+			return checkResult{check, false, "Unable to find the config repo!"}
+		}
+		locales, err := repoLocales(repo, p.hostname)
+		if err != nil {
+			return checkResult{check, false, fmt.Sprintf("Unable to read the locales in sysfiles: %v", err)}
+		}
+		langFound := false
+		for _, locale := range locales {
+			if !available[locale] {
+				return checkResult{check, false, fmt.Sprintf("Unknown locale %s in sysfiles! See /usr/share/i18n/SUPPORTED.", locale)}
+			}
+			langFound = langFound || strings.Fields(locale)[0] == p.lang
+		}
+		if !langFound {
+			return checkResult{check, false, fmt.Sprintf("LANG %s is not one of the locales in sysfiles!", p.lang)}
+		}
+	}
+
+	keymaps, _ := filepath.Glob("/usr/share/kbd/keymaps/*/*/" + p.keymap + ".map.gz")
+	if len(keymaps) == 0 {
+		return checkResult{check, false, fmt.Sprintf("Unknown keymap %s! See 'localectl list-keymaps'.", p.keymap)}
+	}
+	return checkResult{check, true, "OK"}
+}
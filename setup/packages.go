@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"overlay"
+)
+
+// Where a local package cache or repo is bind mounted in the installed
+// system, so that sysconf can use it from the chroot.
+const pkgSourceMount = "/var/cache/sysconf-pkgs"
+
+const offlinePacmanConf = "/tmp/setup-pacman.conf"
+
+func bindMountOrDie(src, mountpoint string) {
+	if err := unix.Mount(src, mountpoint, "", unix.MS_BIND, ""); err != nil {
+		printFailure(fmt.Sprintf("Unable to bind mount %s on %s!", src, mountpoint), true)
+		fmt.Println(err)
+		die()
+	}
+	trackMount(src, mountpoint)
+}
+
+func writeOfflinePacmanConf(repoDir string) {
+	file, err := os.Create(offlinePacmanConf)
+	if err == nil {
+		_, err = file.WriteString(overlay.OfflinePacmanConf(repoDir))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		printFailure(fmt.Sprintf("Unable to write %s!", offlinePacmanConf), true)
+		fmt.Println(err)
+		die()
+	}
+}
+
+// Returns the pacstrap arguments for installing pkgs from the package
+// source given on the command line.
+func pacstrapArgs(o options, pkgs []string) []string {
+	switch {
+	case o.pkgRepo != "":
+		writeOfflinePacmanConf(o.pkgRepo)
+		return append([]string{"-C", offlinePacmanConf, "/mnt"}, pkgs...)
+	case o.pkgCache != "":
+		// Extra arguments go to pacman.  --cachedir replaces the target's
+		// cache, so anything missing is downloaded into o.pkgCache.
+		return append(append([]string{"/mnt"}, pkgs...), "--cachedir", o.pkgCache)
+	}
+	return append([]string{"/mnt"}, pkgs...)
+}
+
+// Returns the sysconf arguments that pass the package source through.
+func sysconfPkgArgs(o options) []string {
+	switch {
+	case o.pkgRepo != "":
+		return []string{"-pkgrepo", pkgSourceMount}
+	case o.pkgCache != "":
+		return []string{"-pkgcache", pkgSourceMount}
+	}
+	return nil
+}
+
+func pkgSource(o options) string {
+	if o.pkgRepo != "" {
+		return o.pkgRepo
+	}
+	return o.pkgCache
+}
+
+func offline(o options) bool {
+	return o.pkgRepo != "" && o.repoUrl == ""
+}
+
+func checkPkgSource(p profile, o options) checkResult {
+	check := "Checking local packages"
+	switch {
+	case o.pkgRepo != "" && o.pkgCache != "":
+		return checkResult{check, false, "Use only one of -pkgrepo and -pkgcache!"}
+	case o.pkgRepo != "":
+		if !fileExists(o.pkgRepo + "/" + overlay.OfflineRepo + ".db") {
+			return checkResult{check, false, fmt.Sprintf("No %s.db in %s! Create it with 'sysconf cache-export %s'.", overlay.OfflineRepo, o.pkgRepo, o.pkgRepo)}
+		}
+	case o.pkgCache != "":
+		if !fileExists(o.pkgCache) {
+			return checkResult{check, false, fmt.Sprintf("%s does not exist!", o.pkgCache)}
+		}
+	default:
+		return checkResult{check, true, "Skipped, downloading packages"}
+	}
+	return checkResult{check, true, "OK"}
+}
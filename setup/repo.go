@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The config repo setup is running from, bin/setup is in the repo.
+func localRepo() (string, error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(filepath.Dir(exePath) + "/..")
+}
+
+// Must match the hash the Makefile builds into bin/sysconf, which covers
+// the overlay module it uses too.
+func sysconfSourceHash(repo string) (string, error) {
+	files := []string{}
+	for _, module := range []string{"sysconf", "overlay"} {
+		sources, err := filepath.Glob(repo + "/" + module + "/*.go")
+		if err != nil {
+			return "", err
+		}
+		files = append(append(files, sources...), repo+"/"+module+"/go.mod")
+	}
+	hash := sha256.New()
+	for _, filename := range files {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		hash.Write(data)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// Checks that bin/sysconf in repo was built from the sysconf source next
+// to it, so changes that weren't rebuilt don't get lost.
+func verifySysconf(repo string) error {
+	expected, err := sysconfSourceHash(repo)
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command(repo+"/bin/sysconf", "-sourcehash").Output()
+	if err != nil {
+		return fmt.Errorf("unable to run %s/bin/sysconf: %v", repo, err)
+	}
+	if strings.TrimSpace(string(out)) != expected {
+		return fmt.Errorf("%s/bin/sysconf was not built from the source in %s/sysconf! Rebuild it with 'make sysconf'", repo, repo)
+	}
+	return nil
+}
+
+func checkSysconfBinary(p profile, o options) checkResult {
+	check := "Checking sysconf binary matches its source"
+	if o.repoUrl != "" {
+		return checkResult{check, true, "Skipped, checked after cloning"}
+	}
+	repo, err := localRepo()
+	if err != nil {
+		return checkResult{check, false, "Unable to find the config repo!"}
+	}
+	if err = verifySysconf(repo); err != nil {
+		return checkResult{check, false, err.Error()}
+	}
+	return checkResult{check, true, "OK"}
+}
+
+// Puts the config repo in the owner's home, either copied from the repo
+// setup is running from, including any uncommitted changes, or cloned.
+func installRepo(o options, owner, repoPath string) {
+	if o.repoUrl == "" {
+		repo, err := localRepo()
+		if err != nil {
+			printFailure("Unable to find the config repo!", true)
+			fmt.Println(err)
+			die()
+		}
+		mkdirOrDie("/mnt"+repoPath, 0755)
+		runOrDie("cp", "-a", repo+"/.", "/mnt"+repoPath)
+		runOrDie("arch-chroot", "/mnt", "chown", "-R", owner+":", repoPath)
+		return
+	}
+
+	runOrDie("arch-chroot", "-u", owner, "/mnt", "git", "clone", o.repoUrl, repoPath)
+	if o.repoRef != "" {
+		runOrDie("arch-chroot", "-u", owner, "/mnt", "git", "-C", repoPath, "checkout", o.repoRef)
+	}
+	if err := verifySysconf("/mnt" + repoPath); err != nil {
+		printFailure(err.Error(), true)
+		die()
+	}
+}
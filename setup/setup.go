@@ -6,20 +6,50 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"golang.org/x/sys/unix"
 )
 
-type system struct {
-	disks int
-	setup func([]string)
+type profile struct {
+	hostname string
+	disks    int
+	// Size of the ESP in MiB and where it is mounted in the installed system
+	espSize  uint
+	espMount string
+	// Smallest disk in GiB the install will fit on
+	minDiskSize uint64
+	// The first user owns the config repo
+	users []user
+	// "lock" to lock the root account, "password" to set its password or
+	// "" to leave it as pacstrap created it
+	root             string
+	rootPasswordHash string
+	// A zone in /usr/share/zoneinfo
+	timezone string
+	// One of the locales in the host's sysfiles, which sysconf enables
+	lang   string
+	keymap string
 }
 
-type checkResult struct {
-	check   string
-	success bool
-	msg     string
+// How to install, from the command line
+type options struct {
+	disks  []string
+	resume bool
+	// Where to get the config repo from, the repo setup is running from
+	// is copied when repoUrl is empty
+	repoUrl string
+	repoRef string
+	// A local repo made by 'sysconf cache-export' to install offline from,
+	// or a package cache to use before downloading
+	pkgRepo  string
+	pkgCache string
+}
+
+type mount struct {
+	device     string
+	mountpoint string
 }
 
 type strSliceArgs []string
@@ -50,62 +80,30 @@ func printSuccess(msg string, eol bool) {
 	printColor("[32m", msg, eol)
 }
 
-func checkIsRoot(disks []string) checkResult {
-	check := "Checking root user"
-	msg := "Must be run as root user!"
-	success := os.Getuid() == 0
-	if success {
-		msg = "OK"
-	}
-	return checkResult{check, success, msg}
-}
-
-func checkInstallDisks(disks []string) checkResult {
-	check := "Checking devices exist"
-	for _, disk := range disks {
-		_, err := os.Stat("/sys/block/" + disk)
-		if err != nil {
-			msg := fmt.Sprintf("%s does not exist or is not a disk", disk)
-			return checkResult{check, false, msg}
-		}
-	}
-	return checkResult{check, true, "OK"}
-}
-
-func checkInstallDisksForPartitions(disks []string) checkResult {
-	check := "Checking install device for partitions"
-	for _, disk := range disks {
-		dir := fmt.Sprintf("/sys/block/%s", disk)
-		files, err := ioutil.ReadDir(dir)
-		if err != nil {
-			return checkResult{check, false, fmt.Sprintf("Error reading %s!", dir)}
-		}
-		partitions := 0
-		for _, file := range files {
-			if file.IsDir() {
-				_, err := os.Stat(fmt.Sprintf("%s/%s/partition", dir, file.Name()))
-				if err == nil {
-					partitions++
-				}
-			}
-		}
-		if partitions != 0 {
-			return checkResult{check, false, fmt.Sprintf("Found %d partitions on %s!", partitions, disk)}
-		}
-	}
-	return checkResult{check, true, "OK"}
-}
-
 func runOrDie(name string, args ...string) {
 	cmd := exec.Command(name, args...)
 	err := cmd.Run()
 
 	if err != nil {
 		printFailure(fmt.Sprintf("Unable to run command: %s %v!", name, args), true)
-		os.Exit(1)
+		die()
 	}
 }
 
+func readMounts() ([]mount, error) {
+	data, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	mounts := []mount{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			mounts = append(mounts, mount{fields[0], fields[1]})
+		}
+	}
+	return mounts, nil
+}
+
 func strToMountOpts(opts string) (uintptr, string) {
 	optSlice := strings.Split(opts, ",")
 	var mountOpts uintptr = 0
@@ -132,8 +130,9 @@ func mountOrDie(fs, partition, mountpoint, opts string) {
 	if err != nil {
 		printFailure(fmt.Sprintf("Unable to mount %s on %s!", mountpoint, partition), true)
 		fmt.Println(err)
-		os.Exit(1)
+		die()
 	}
+	trackMount(partition, mountpoint)
 }
 
 func mountBtrfsOrDie(partition, mountpoint, opts, subvol string) {
@@ -147,15 +146,16 @@ func unmountOrDie(mountpoint string) {
 	if err != nil {
 		printFailure(fmt.Sprintf("Unable to unmount %s!", mountpoint), true)
 		fmt.Println(err)
-		os.Exit(1)
+		die()
 	}
+	untrackMount(mountpoint)
 }
 
 func mkdirOrDie(path string, perms os.FileMode) {
 	err := os.MkdirAll(path, perms)
 	if err != nil {
 		printFailure(fmt.Sprintf("Unable create %s!", path), true)
-		os.Exit(1)
+		die()
 	}
 }
 
@@ -166,12 +166,29 @@ func getUuidOrDie(part string) string {
 
 	if err != nil {
 		printFailure(fmt.Sprintf("Unable to get uuid for %s!", part), true)
-		os.Exit(1)
+		die()
 	}
 
 	return strings.TrimSpace(string(out))
 }
 
+// Bind mounts and file:// urls need absolute paths
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+func fileExists(fullpath string) bool {
+	_, err := os.Stat(fullpath)
+	return err == nil
+}
+
 func partName(disk string, num uint) string {
 	prefix := ""
 	if strings.Contains(disk, "nvme") {
@@ -180,251 +197,284 @@ func partName(disk string, num uint) string {
 	return fmt.Sprintf("/dev/%s%s%d", disk, prefix, num)
 }
 
-func runInteractiveOrDie(name string, args ...string) {
+func runWithInputOrDie(input string, name string, args ...string) {
 	cmd := exec.Command(name, args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdin = strings.NewReader(input)
 
 	err := cmd.Run()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to run command: %s %v!", name, args)
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		printFailure(fmt.Sprintf("Unable to run command: %s %v!", name, args), true)
+		die()
 	}
 }
 
-func ultra24(disks []string) {
-	disk := disks[0]
-	hostname := "ultra24"
-	btrfsOpts := "rw,relatime,compress=zstd,ssd,space_cache"
-	fat32Opts := "rw,relatime,fmask=0022,dmask=0022,codepage=437,iocharset=iso8859-1,shortname=mixed,utf8,errors=remount-ro"
-
-	fmt.Print("Creating partitions...")
-
-	dev := fmt.Sprintf("/dev/%s", disk)
-	runOrDie("parted", "-s", dev, "mklabel", "gpt")
-	runOrDie("parted", "-s", dev, "mkpart", "BOOT", "fat32", "1MiB", "513MiB")
-	runOrDie("parted", "-s", dev, "set", "1", "esp", "on")
-	runOrDie("parted", "-s", dev, "mkpart", "ROOT", "btrfs", "513Mib", "100%")
-
-	printSuccess("OK", true)
-
-	fmt.Print("Formatting partitions...")
-
-	bootPart := partName(disk, 1)
-	rootPart := partName(disk, 2)
-
-	runOrDie("mkfs.fat", "-F", "32", bootPart)
-	runOrDie("mkfs.btrfs", "-f", rootPart)
-
-	printSuccess("OK", true)
-
-	fmt.Print("Creating btrfs subvolumes...")
-
-	mountBtrfsOrDie(rootPart, "/mnt", btrfsOpts, "/")
-
-	runOrDie("btrfs", "subvolume", "create", "/mnt/@")
-	runOrDie("btrfs", "subvolume", "create", "/mnt/@home")
-	runOrDie("btrfs", "subvolume", "create", "/mnt/@tmp")
-	runOrDie("btrfs", "subvolume", "create", "/mnt/@snapshots")
-
-	unmountOrDie("/mnt")
-
-	printSuccess("OK", true)
-
-	fmt.Print("Mounting partitions for install...")
-
-	var perms os.FileMode = 0777
-
-	mountBtrfsOrDie(rootPart, "/mnt", btrfsOpts, "@")
-	mkdirOrDie("/mnt/home", perms)
-	mountBtrfsOrDie(rootPart, "/mnt/home", btrfsOpts, "@home")
-	mkdirOrDie("/mnt/tmp", perms)
-	mountBtrfsOrDie(rootPart, "/mnt/tmp", btrfsOpts, "@tmp")
-	mkdirOrDie("/mnt/mnt/snapshots", perms)
-	mountBtrfsOrDie(rootPart, "/mnt/mnt/snapshots", btrfsOpts, "/")
-	mkdirOrDie("/mnt/boot/efi", perms)
-	mountOrDie("vfat", bootPart, "/mnt/boot/efi", fat32Opts)
-
-	printSuccess("OK", true)
-
-	fmt.Print("Running pacstrap...")
-	runOrDie("pacstrap", "/mnt", "base", "btrfs-progs", "linux", "linux-firmware", "git")
-	printSuccess("OK", true)
-
-	fmt.Print("Creating fstab...")
-	espUuid := getUuidOrDie(partName(disk, 1))
-	btrfsUuid := getUuidOrDie(partName(disk, 2))
-
-	file, err := os.OpenFile("/mnt/etc/fstab", os.O_WRONLY|os.O_CREATE, 0664)
+func lsblkField(part, field string) string {
+	out, err := exec.Command("lsblk", "-n", "-o", field, part).Output()
 	if err != nil {
-		printFailure("Unable to create fstab!", true)
-		os.Exit(1)
+		return ""
 	}
-	file.WriteString("# Generated automatically - remember to update the setup script if updating this file!\n")
-	file.WriteString(fmt.Sprintf("UUID=%s / btrfs %s,subvol=@ 0 0\n", btrfsUuid, btrfsOpts))
-	file.WriteString(fmt.Sprintf("UUID=%s /boot/efi vfat %s 0 2\n", espUuid, fat32Opts))
-	file.WriteString(fmt.Sprintf("UUID=%s /home btrfs %s,subvol=@home 0 0\n", btrfsUuid, btrfsOpts))
-	file.WriteString(fmt.Sprintf("UUID=%s /tmp btrfs %s,subvol=@tmp 0 0\n", btrfsUuid, btrfsOpts))
-	file.WriteString(fmt.Sprintf("UUID=%s /mnt/snapshots btrfs %s,subvol=@snapshots 0 0\n", btrfsUuid, btrfsOpts))
+	return strings.TrimSpace(string(out))
+}
 
-	if err = file.Close(); err != nil {
-		printFailure("Unable to close fstab! For some reason!", true)
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+func isMounted(mountpoint string) bool {
+	mounts, err := readMounts()
+	if err != nil {
+		return false
 	}
+	for _, m := range mounts {
+		if m.mountpoint == mountpoint {
+			return true
+		}
+	}
+	return false
+}
 
-	printSuccess("OK", true)
-
-	fmt.Print("Setting timezone...")
-	runOrDie("arch-chroot", "/mnt", "ln", "-sf", "/usr/share/zoneinfo/Europe/London", "/etc/localtime")
-	runOrDie("arch-chroot", "/mnt", "hwclock", "--systohc")
-	printSuccess("OK", true)
-
-	fmt.Print("Creating User...")
-	runOrDie("arch-chroot", "/mnt", "useradd", "-m", "-G", "wheel", "andy")
-	printSuccess("OK", true)
-
-	fmt.Print("Cloning Config Repo...")
-	runOrDie("arch-chroot", "-u", "andy", "/mnt", "git", "clone", "https://github.com/andypott/config", "/home/andy/config")
-	printSuccess("OK", true)
-
-	fmt.Print("Configuring installed system...")
-	runOrDie("arch-chroot", "/mnt", "/home/andy/config/bin/sysconf", "-system", hostname, "-installgrub")
-	printSuccess("OK", true)
-
-	fmt.Println("Please set your password...")
-	runInteractiveOrDie("arch-chroot", "/mnt", "passwd", "andy")
-	printSuccess("...OK", true)
-
+func fileContains(filename, text string) bool {
+	data, err := ioutil.ReadFile(filename)
+	return err == nil && strings.Contains(string(data), text)
 }
 
-func razerbook(disks []string) {
-	disk := disks[0]
-	hostname := "razerbook"
+func installSteps(p profile, o options, a answers) []step {
+	disk := o.disks[0]
+	owner := p.users[0].name
+	repoPath := "/home/" + owner + "/config"
 	btrfsOpts := "rw,relatime,compress=zstd,ssd,space_cache"
 	fat32Opts := "rw,relatime,fmask=0022,dmask=0022,codepage=437,iocharset=iso8859-1,shortname=mixed,utf8,errors=remount-ro"
+	espEnd := fmt.Sprintf("%dMiB", 1+p.espSize)
+	bootPart := partName(disk, 1)
+	rootPart := partName(disk, 2)
+	basePkgs := []string{"base", "btrfs-progs", "linux", "linux-firmware", "git"}
+	fstabHeader := "# Generated automatically - remember to update the setup script if updating this file!\n"
 
-	fmt.Print("Creating partitions...")
-
-	dev := fmt.Sprintf("/dev/%s", disk)
-	runOrDie("parted", "-s", dev, "mklabel", "gpt")
-	runOrDie("parted", "-s", dev, "mkpart", "BOOT", "fat32", "1MiB", "513MiB")
-	runOrDie("parted", "-s", dev, "set", "1", "esp", "on")
-	runOrDie("parted", "-s", dev, "mkpart", "ROOT", "btrfs", "513Mib", "100%")
-
-	printSuccess("OK", true)
+	partition := func() {
+		fmt.Print("Creating partitions...")
 
-	fmt.Print("Formatting partitions...")
+		dev := fmt.Sprintf("/dev/%s", disk)
+		runOrDie("parted", "-s", dev, "mklabel", "gpt")
+		runOrDie("parted", "-s", dev, "mkpart", "BOOT", "fat32", "1MiB", espEnd)
+		runOrDie("parted", "-s", dev, "set", "1", "esp", "on")
+		runOrDie("parted", "-s", dev, "mkpart", "ROOT", "btrfs", espEnd, "100%")
 
-	bootPart := partName(disk, 1)
-	rootPart := partName(disk, 2)
+		printSuccess("OK", true)
+	}
 
-	runOrDie("mkfs.fat", "-F", "32", bootPart)
-	runOrDie("mkfs.btrfs", "-f", rootPart)
+	format := func() {
+		fmt.Print("Formatting partitions...")
 
-	printSuccess("OK", true)
+		runOrDie("mkfs.fat", "-F", "32", bootPart)
+		runOrDie("mkfs.btrfs", "-f", rootPart)
 
-	fmt.Print("Creating btrfs subvolumes...")
+		printSuccess("OK", true)
+	}
 
-	mountBtrfsOrDie(rootPart, "/mnt", btrfsOpts, "/")
+	// Only creates the subvolumes that are missing, so it can run again
+	// when resuming after the checkpoint is lost
+	subvolumes := func() {
+		fmt.Print("Creating btrfs subvolumes...")
 
-	runOrDie("btrfs", "subvolume", "create", "/mnt/@")
-	runOrDie("btrfs", "subvolume", "create", "/mnt/@home")
-	runOrDie("btrfs", "subvolume", "create", "/mnt/@tmp")
-	runOrDie("btrfs", "subvolume", "create", "/mnt/@snapshots")
+		mountBtrfsOrDie(rootPart, "/mnt", btrfsOpts, "/")
 
-	unmountOrDie("/mnt")
+		for _, subvol := range []string{"@", "@home", "@tmp", "@snapshots"} {
+			if _, err := os.Stat("/mnt/" + subvol); err != nil {
+				runOrDie("btrfs", "subvolume", "create", "/mnt/"+subvol)
+			}
+		}
 
-	printSuccess("OK", true)
+		unmountOrDie("/mnt")
 
-	fmt.Print("Mounting partitions for install...")
+		printSuccess("OK", true)
+	}
 
-	var perms os.FileMode = 0777
+	mountAll := func() {
+		fmt.Print("Mounting partitions for install...")
+
+		var perms os.FileMode = 0777
+
+		for _, m := range []struct{ mountpoint, subvol string }{
+			{"/mnt", "@"},
+			{"/mnt/home", "@home"},
+			{"/mnt/tmp", "@tmp"},
+			{"/mnt/mnt/snapshots", "/"},
+		} {
+			// Left mounted by a previous run, already tracked by resuming
+			if !isMounted(m.mountpoint) {
+				mkdirOrDie(m.mountpoint, perms)
+				mountBtrfsOrDie(rootPart, m.mountpoint, btrfsOpts, m.subvol)
+			}
+		}
+		if !isMounted("/mnt" + p.espMount) {
+			mkdirOrDie("/mnt"+p.espMount, perms)
+			mountOrDie("vfat", bootPart, "/mnt"+p.espMount, fat32Opts)
+		}
+		if src := pkgSource(o); src != "" && !isMounted("/mnt"+pkgSourceMount) {
+			mkdirOrDie("/mnt"+pkgSourceMount, 0755)
+			bindMountOrDie(src, "/mnt"+pkgSourceMount)
+		}
 
-	mountBtrfsOrDie(rootPart, "/mnt", btrfsOpts, "@")
-	mkdirOrDie("/mnt/home", perms)
-	mountBtrfsOrDie(rootPart, "/mnt/home", btrfsOpts, "@home")
-	mkdirOrDie("/mnt/tmp", perms)
-	mountBtrfsOrDie(rootPart, "/mnt/tmp", btrfsOpts, "@tmp")
-	mkdirOrDie("/mnt/mnt/snapshots", perms)
-	mountBtrfsOrDie(rootPart, "/mnt/mnt/snapshots", btrfsOpts, "/")
-	mkdirOrDie("/mnt/boot/efi", perms)
-	mountOrDie("vfat", bootPart, "/mnt/boot/efi", fat32Opts)
+		printSuccess("OK", true)
+	}
 
-	printSuccess("OK", true)
+	pacstrap := func() {
+		fmt.Print("Running pacstrap...")
+		runOrDie("pacstrap", pacstrapArgs(o, basePkgs)...)
+		printSuccess("OK", true)
+	}
 
-	fmt.Print("Running pacstrap...")
-	runOrDie("pacstrap", "/mnt", "base", "btrfs-progs", "linux", "linux-firmware", "git")
-	printSuccess("OK", true)
+	fstab := func() {
+		fmt.Print("Creating fstab...")
+		espUuid := getUuidOrDie(bootPart)
+		btrfsUuid := getUuidOrDie(rootPart)
 
-	fmt.Print("Creating fstab...")
-	espUuid := getUuidOrDie(partName(disk, 1))
-	btrfsUuid := getUuidOrDie(partName(disk, 2))
+		file, err := os.OpenFile("/mnt/etc/fstab", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+		if err != nil {
+			printFailure("Unable to create fstab!", true)
+			die()
+		}
+		file.WriteString(fstabHeader)
+		file.WriteString(fmt.Sprintf("UUID=%s / btrfs %s,subvol=@ 0 0\n", btrfsUuid, btrfsOpts))
+		file.WriteString(fmt.Sprintf("UUID=%s %s vfat %s 0 2\n", espUuid, p.espMount, fat32Opts))
+		file.WriteString(fmt.Sprintf("UUID=%s /home btrfs %s,subvol=@home 0 0\n", btrfsUuid, btrfsOpts))
+		file.WriteString(fmt.Sprintf("UUID=%s /tmp btrfs %s,subvol=@tmp 0 0\n", btrfsUuid, btrfsOpts))
+		file.WriteString(fmt.Sprintf("UUID=%s /mnt/snapshots btrfs %s,subvol=@snapshots 0 0\n", btrfsUuid, btrfsOpts))
+
+		if err = file.Close(); err != nil {
+			printFailure("Unable to close fstab! For some reason!", true)
+			fmt.Fprintln(os.Stderr, err)
+			die()
+		}
 
-	file, err := os.OpenFile("/mnt/etc/fstab", os.O_WRONLY|os.O_CREATE, 0664)
-	if err != nil {
-		printFailure("Unable to create fstab!", true)
-		os.Exit(1)
+		printSuccess("OK", true)
 	}
-	file.WriteString("# Generated automatically - remember to update the setup script if updating this file!\n")
-	file.WriteString(fmt.Sprintf("UUID=%s / btrfs %s,subvol=@ 0 0\n", btrfsUuid, btrfsOpts))
-	file.WriteString(fmt.Sprintf("UUID=%s /boot/efi vfat %s 0 2\n", espUuid, fat32Opts))
-	file.WriteString(fmt.Sprintf("UUID=%s /home btrfs %s,subvol=@home 0 0\n", btrfsUuid, btrfsOpts))
-	file.WriteString(fmt.Sprintf("UUID=%s /tmp btrfs %s,subvol=@tmp 0 0\n", btrfsUuid, btrfsOpts))
-	file.WriteString(fmt.Sprintf("UUID=%s /mnt/snapshots btrfs %s,subvol=@snapshots 0 0\n", btrfsUuid, btrfsOpts))
 
-	if err = file.Close(); err != nil {
-		printFailure("Unable to close fstab! For some reason!", true)
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	timezone := func() {
+		fmt.Print("Setting timezone...")
+		setTimezone(p.timezone)
+		printSuccess("OK", true)
 	}
 
-	printSuccess("OK", true)
+	locale := func() {
+		fmt.Print("Setting locale and keymap...")
+		setLang(p)
+		setKeymap(p)
+		printSuccess("OK", true)
+	}
 
-	fmt.Print("Setting timezone...")
-	runOrDie("arch-chroot", "/mnt", "ln", "-sf", "/usr/share/zoneinfo/Europe/London", "/etc/localtime")
-	runOrDie("arch-chroot", "/mnt", "hwclock", "--systohc")
-	printSuccess("OK", true)
+	hostname := func() {
+		fmt.Print("Setting hostname...")
+		setHostname(p)
+		printSuccess("OK", true)
+	}
 
-	fmt.Print("Creating User...")
-	runOrDie("arch-chroot", "/mnt", "useradd", "-m", "-G", "wheel", "andy")
-	printSuccess("OK", true)
+	users := func() {
+		fmt.Print("Creating Users...")
+		createUsers(p)
+		printSuccess("OK", true)
+	}
 
-	fmt.Print("Cloning Config Repo...")
-	runOrDie("arch-chroot", "-u", "andy", "/mnt", "git", "clone", "https://github.com/andypott/config", "/home/andy/config")
-	printSuccess("OK", true)
+	passwd := func() {
+		fmt.Print("Setting passwords...")
+		setPasswords(p, a.passwords)
+		printSuccess("OK", true)
+	}
 
-	fmt.Print("Configuring installed system...")
-	runOrDie("arch-chroot", "/mnt", "/home/andy/config/bin/sysconf", "-system", hostname, "-installgrub")
-	printSuccess("OK", true)
+	repo := func() {
+		fmt.Print("Installing Config Repo...")
+		installRepo(o, owner, repoPath)
+		printSuccess("OK", true)
+	}
 
-	fmt.Println("Please set your password...")
-	runInteractiveOrDie("arch-chroot", "/mnt", "passwd", "andy")
-	printSuccess("...OK", true)
+	// sysconf finds the ESP from the mounts, so it will use p.espMount
+	sysconf := func() {
+		fmt.Print("Configuring installed system...")
+		args := append([]string{"/mnt", repoPath + "/bin/sysconf", "-system", p.hostname, "-installbootloader"}, sysconfPkgArgs(o)...)
+		runOrDie("arch-chroot", args...)
+		printSuccess("OK", true)
+	}
 
+	return []step{
+		{"partition", func() bool {
+			return lsblkField(bootPart, "PARTLABEL") == "BOOT" && lsblkField(rootPart, "PARTLABEL") == "ROOT"
+		}, partition},
+		{"format", func() bool {
+			return lsblkField(bootPart, "FSTYPE") == "vfat" && lsblkField(rootPart, "FSTYPE") == "btrfs"
+		}, format},
+		{"subvolumes", nil, subvolumes},
+		// Always run, it leaves mounts from a previous run alone, and a
+		// failed run unmounts everything anyway
+		{"mount", func() bool { return false }, mountAll},
+		{"pacstrap", func() bool {
+			return exec.Command("pacman", append([]string{"--root", "/mnt", "-Q"}, basePkgs...)...).Run() == nil
+		}, pacstrap},
+		{"fstab", func() bool { return fileContains("/mnt/etc/fstab", fstabHeader) }, fstab},
+		{"timezone", nil, timezone},
+		{"locale", nil, locale},
+		{"hostname", nil, hostname},
+		{"users", func() bool { return usersCreated(p) }, users},
+		{"passwords", nil, passwd},
+		{"repo", func() bool { return fileExists("/mnt" + repoPath + "/bin/sysconf") }, repo},
+		{"sysconf", nil, sysconf},
+	}
 }
 
 func main() {
-	systems := map[string]system{
-		"ultra24":   {disks: 1, setup: ultra24},
-		"razerbook": {disks: 1, setup: razerbook},
+	systems := map[string]profile{
+		"ultra24": {
+			hostname:    "ultra24",
+			disks:       1,
+			espSize:     512,
+			espMount:    "/boot/efi",
+			minDiskSize: 64,
+			users: []user{
+				{name: "andy", shell: "/bin/bash", groups: []string{"wheel", "video", "audio", "input"}},
+			},
+			root:     "lock",
+			timezone: "Europe/London",
+			lang:     "en_GB.UTF-8",
+			keymap:   "uk",
+		},
+		"razerbook": {
+			hostname:    "razerbook",
+			disks:       1,
+			espSize:     512,
+			espMount:    "/boot/efi",
+			minDiskSize: 64,
+			users: []user{
+				{name: "andy", shell: "/bin/bash", groups: []string{"wheel", "video", "audio", "input"}},
+			},
+			root:     "lock",
+			timezone: "Europe/London",
+			lang:     "en_GB.UTF-8",
+			keymap:   "uk",
+		},
 	}
 
 	var system string
 	var disks strSliceArgs
+	var checkOnly bool
+	var resume bool
+	var cleanupOnly bool
+	var repoUrl string
+	var repoRef string
+	var pkgRepo string
+	var pkgCache string
 	flag.StringVar(&system, "system", "", "Required. The hostname of the system to setup")
-	flag.Var(&disks, "disks", "Required. Comma seperated list of disks to use. Order matters!!")
+	flag.Var(&disks, "disks", "Optional. Comma seperated list of disks to use. Order matters!! Chosen interactively when not given.")
+	flag.BoolVar(&checkOnly, "check-only", false, "Optional. Run the pre-flight checks and exit.")
+	flag.BoolVar(&resume, "resume", false, "Optional. Continue a failed install from the first incomplete step.")
+	flag.StringVar(&repoUrl, "repo-url", "", "Optional. Clone the config repo from this url instead of copying the one setup is running from.")
+	flag.StringVar(&repoRef, "repo-ref", "", "Optional. Branch, tag or commit to check out when cloning with -repo-url.")
+	flag.StringVar(&pkgRepo, "pkgrepo", "", "Optional. Install offline from a local repo made by 'sysconf cache-export'.")
+	flag.StringVar(&pkgCache, "pkgcache", "", "Optional. Use packages from this cache directory before downloading them.")
+	flag.BoolVar(&cleanupOnly, "cleanup", false, "Optional. Unmount a half-finished install left by a previous run and exit.")
 
 	flag.Parse()
 
-	if system == "" {
-		flag.Usage()
-		os.Exit(1)
+	if cleanupOnly {
+		cleanupPrevious()
+		return
 	}
 
-	if len(disks) == 0 {
+	if system == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -434,35 +484,27 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(disks) == 0 {
+		disks = pickDisks(systems[system].disks)
+	}
+
 	if len(disks) != systems[system].disks {
 		fmt.Fprintf(os.Stderr, "%s requires exactly %d disks\n", system, systems[system].disks)
 		os.Exit(1)
 	}
 
-	checks := []func([]string) checkResult{
-		checkIsRoot,
-		checkInstallDisks,
-		checkInstallDisksForPartitions,
-	}
-
-	failures := 0
-	for _, c := range checks {
-		res := c(disks)
-		fmt.Print(res.check)
-		fmt.Print("...")
-		if res.success {
-			printSuccess(res.msg, true)
-		} else {
-			printFailure(res.msg, true)
-			failures++
-		}
-	}
-
-	if failures > 0 {
+	o := options{disks, resume, repoUrl, repoRef, absPath(pkgRepo), absPath(pkgCache)}
+	if !runChecks(systems[system], o) {
 		printFailure("All checks must pass to continue. Exiting.", true)
 		os.Exit(1)
-	} else {
-		printSuccess("All checks passed", true)
-		systems[system].setup(disks)
 	}
+	printSuccess("All checks passed", true)
+	if checkOnly {
+		return
+	}
+
+	cleanupOnInterrupt()
+	a := runWizard(systems[system], o)
+	runSteps(installSteps(systems[system], o, a), systems[system], o)
+	cleanup()
 }
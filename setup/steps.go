@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const checkpointFile = "/tmp/setup-checkpoint"
+
+type step struct {
+	name string
+	// Reports whether the step's work is already on disk.  Steps without
+	// one are only considered done when recorded in the checkpoint file,
+	// which is lost if the install media reboots, so they have to be safe
+	// to run again.
+	done func() bool
+	run  func()
+}
+
+// The first line of the checkpoint identifies the install, so resuming
+// with a different system or disks starts again.
+func checkpointHeader(p profile, o options) string {
+	return p.hostname + " " + strings.Join(o.disks, ",")
+}
+
+func readCheckpoint(p profile, o options) map[string]bool {
+	completed := map[string]bool{}
+	file, err := os.Open(checkpointFile)
+	if err != nil {
+		return completed
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || scanner.Text() != checkpointHeader(p, o) {
+		return completed
+	}
+	for scanner.Scan() {
+		completed[scanner.Text()] = true
+	}
+	return completed
+}
+
+func resetCheckpoint(p profile, o options) {
+	err := ioutil.WriteFile(checkpointFile, []byte(checkpointHeader(p, o)+"\n"), 0600)
+	if err != nil {
+		printFailure(fmt.Sprintf("Unable to write %s!", checkpointFile), true)
+		fmt.Println(err)
+		die()
+	}
+}
+
+func writeCheckpoint(name string) {
+	file, err := os.OpenFile(checkpointFile, os.O_WRONLY|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = file.WriteString(name + "\n")
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		printFailure(fmt.Sprintf("Unable to update %s!", checkpointFile), true)
+		fmt.Println(err)
+		die()
+	}
+}
+
+// Runs the steps in order.  When resuming, each step whose work is already
+// done is skipped, so a resume picks up wherever the last run failed
+// rather than redoing every step after the first incomplete one.
+func runSteps(steps []step, p profile, o options) {
+	completed := map[string]bool{}
+	if o.resume {
+		trackPreviousMounts()
+		completed = readCheckpoint(p, o)
+	}
+	// Only keep the record of the steps done by this run or skipped
+	resetCheckpoint(p, o)
+
+	for _, s := range steps {
+		if o.resume && ((s.done != nil && s.done()) || (s.done == nil && completed[s.name])) {
+			fmt.Printf("Skipping completed step %s\n", s.name)
+		} else {
+			s.run()
+		}
+		writeCheckpoint(s.name)
+	}
+	os.Remove(checkpointFile)
+}
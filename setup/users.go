@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+type user struct {
+	name     string
+	fullName string
+	shell    string
+	// Supplementary groups, wheel is needed for sudo
+	groups []string
+	// 0 lets useradd pick the next free uid
+	uid int
+	// A crypt(3) hash, e.g. from 'openssl passwd -6'.  When empty the
+	// password is asked for before the install starts.
+	passwordHash string
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+func readLine() string {
+	line, err := stdin.ReadString('\n')
+	if err != nil {
+		fmt.Println()
+		printFailure("Unable to read from stdin!", true)
+		die()
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func readPassword(prompt string) string {
+	fmt.Print(prompt)
+
+	// Turn off echo while the password is typed, when stdin is a terminal
+	fd := int(os.Stdin.Fd())
+	if termios, err := unix.IoctlGetTermios(fd, unix.TCGETS); err == nil {
+		noEcho := *termios
+		noEcho.Lflag &^= unix.ECHO
+		saveTerminal(termios)
+		unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho)
+		defer fmt.Println()
+		defer restoreTerminal()
+	}
+
+	return readLine()
+}
+
+func askNewPassword(account string) string {
+	for {
+		password := readPassword(fmt.Sprintf("New password for %s: ", account))
+		if password == "" {
+			printFailure("Password must not be empty!", true)
+			continue
+		}
+		if readPassword("Retype password: ") != password {
+			printFailure("Passwords do not match!", true)
+			continue
+		}
+		return password
+	}
+}
+
+// Asks for the passwords that the profile doesn't supply a hash for, so
+// that nothing needs typing once the install has started.  Returns the
+// plain text passwords by account name.
+func askPasswords(p profile) map[string]string {
+	passwords := map[string]string{}
+	for _, u := range p.users {
+		if u.passwordHash == "" {
+			passwords[u.name] = askNewPassword(u.name)
+		}
+	}
+	if p.root == "password" && p.rootPasswordHash == "" {
+		passwords["root"] = askNewPassword("root")
+	}
+	return passwords
+}
+
+// Skips users that already exist, from a previous run being resumed.
+func createUsers(p profile) {
+	for _, u := range p.users {
+		if userExists(u.name) {
+			continue
+		}
+		args := []string{"/mnt", "useradd", "-m"}
+		if len(u.groups) != 0 {
+			args = append(args, "-G", strings.Join(u.groups, ","))
+		}
+		if u.fullName != "" {
+			args = append(args, "-c", u.fullName)
+		}
+		if u.shell != "" {
+			args = append(args, "-s", u.shell)
+		}
+		if u.uid != 0 {
+			args = append(args, "-u", strconv.Itoa(u.uid))
+		}
+		runOrDie("arch-chroot", append(args, u.name)...)
+	}
+}
+
+func userExists(name string) bool {
+	return fileContains("/mnt/etc/passwd", "\n"+name+":")
+}
+
+func usersCreated(p profile) bool {
+	for _, u := range p.users {
+		if !userExists(u.name) {
+			return false
+		}
+	}
+	return true
+}
+
+func setPasswords(p profile, passwords map[string]string) {
+	plain := ""
+	hashed := ""
+	for _, u := range p.users {
+		if u.passwordHash != "" {
+			hashed += u.name + ":" + u.passwordHash + "\n"
+		} else {
+			plain += u.name + ":" + passwords[u.name] + "\n"
+		}
+	}
+
+	switch p.root {
+	case "lock":
+		runOrDie("arch-chroot", "/mnt", "passwd", "-l", "root")
+	case "password":
+		if p.rootPasswordHash != "" {
+			hashed += "root:" + p.rootPasswordHash + "\n"
+		} else {
+			plain += "root:" + passwords["root"] + "\n"
+		}
+	}
+
+	if plain != "" {
+		runWithInputOrDie(plain, "arch-chroot", "/mnt", "chpasswd")
+	}
+	if hashed != "" {
+		runWithInputOrDie(hashed, "arch-chroot", "/mnt", "chpasswd", "-e")
+	}
+}
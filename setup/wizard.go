@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Everything the install needs from the user, asked for before it starts
+// so that the rest of the run is unattended.
+type answers struct {
+	passwords map[string]string
+}
+
+func askYesNo(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer := strings.ToLower(strings.TrimSpace(readLine()))
+	return answer == "y" || answer == "yes"
+}
+
+// Makes the user type each device name, so a wrong disk isn't wiped by
+// just pressing y.
+func confirmDisks(disks []string) bool {
+	fmt.Println("The following disks will be wiped, ALL DATA ON THEM WILL BE LOST:")
+	for _, disk := range disks {
+		fmt.Printf("    %s\n", describeDisk(disk))
+	}
+	for _, disk := range disks {
+		fmt.Printf("Type %s to confirm: ", disk)
+		if strings.TrimSpace(readLine()) != disk {
+			return false
+		}
+	}
+	return true
+}
+
+func runWizard(p profile, o options) answers {
+	if o.resume {
+		fmt.Printf("Resuming install of %s on:\n", p.hostname)
+		for _, disk := range o.disks {
+			fmt.Printf("    %s\n", describeDisk(disk))
+		}
+	} else if !confirmDisks(o.disks) {
+		printFailure("Not confirmed. Exiting.", true)
+		die()
+	}
+
+	if !askYesNo(fmt.Sprintf("Install as %s?", p.hostname)) {
+		printFailure("Not confirmed. Exiting.", true)
+		die()
+	}
+
+	a := answers{}
+	a.passwords = askPasswords(p)
+
+	printSuccess("Got everything needed, the install will now run unattended.", true)
+	return a
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Copies a live file into a layer's files, recording its mode and owner in
+// the layer's perms file when they aren't the default.  The copy is owned
+// by whoever owns the layer so it can be committed without root.
+func adoptCommand(path string, layerDir string) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		fmt.Fprintf(os.Stderr, "%s is not a regular file!\n", path)
+		os.Exit(1)
+	}
+	dest := layerDir + "/files" + path
+	if _, err := os.Lstat(dest); err == nil {
+		fmt.Fprintf(os.Stderr, "%s is already in the repo!\n", dest)
+		os.Exit(1)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read %s!\n", path)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	writeFileOrDie(dest, string(data), 0644)
+
+	layer, err := os.Stat(layerDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	layerStat := layer.Sys().(*syscall.Stat_t)
+	for dir := dest; strings.HasPrefix(dir, layerDir+"/"); dir = filepath.Dir(dir) {
+		os.Chown(dir, int(layerStat.Uid), int(layerStat.Gid))
+	}
+
+	stat := info.Sys().(*syscall.Stat_t)
+	owner, group := "root", "root"
+	if u, err := user.LookupId(strconv.Itoa(int(stat.Uid))); err == nil {
+		owner = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.Itoa(int(stat.Gid))); err == nil {
+		group = g.Name
+	}
+	mode := info.Mode().Perm()
+	if mode == 0644 && owner == "root" && group == "root" {
+		return
+	}
+
+	line := fmt.Sprintf("%s %04o", path, mode)
+	if owner != "root" || group != "root" {
+		line += " " + owner + " " + group
+	}
+	permsFile := layerDir + "/perms"
+	file, err := os.OpenFile(permsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = file.WriteString(line + "\n")
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to update %s!\n", permsFile)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Chown(permsFile, int(layerStat.Uid), int(layerStat.Gid))
+}
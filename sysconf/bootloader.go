@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where the ESP is looked for when the host settings don't set esp=.
+var espCandidates = []string{"/efi", "/boot/efi", "/boot"}
+
+const bootloaderHook = "/etc/pacman.d/hooks/95-sysconf-bootloader.hook"
+
+type bootloader interface {
+	// Installs the bootloader to the ESP, only needed on first setup.
+	install()
+	// Regenerates the boot menu for the installed kernels and snapshots.
+	update()
+	// Regenerates just the snapshot entries, after taking or pruning them.
+	updateSnapshots()
+}
+
+// Finds the ESP from the current mounts, so re-running sysconf on an
+// installed machine (or from setup's chroot) uses wherever it is mounted.
+func findEspOrDie(s settings) string {
+	if esp, ok := s["esp"]; ok {
+		return esp
+	}
+	mounts := readMountsOrDie()
+	for _, candidate := range espCandidates {
+		if m, ok := findMount(mounts, candidate); ok && m.fstype == "vfat" {
+			return candidate
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Unable to find the ESP, set esp= in the host settings.")
+	os.Exit(1)
+	return ""
+}
+
+// The ESP is only looked up by the bootloaders when installing or updating,
+// so commands that don't touch the boot menu work without it mounted.
+func newBootloader(s settings, snapshotBoot string, snapshotEntries int) bootloader {
+	switch name := s.get("bootloader", "grub"); name {
+	case "grub":
+		return grub{
+			hostSettings:    s,
+			bootloaderId:    s.get("bootloaderid", "Arch"),
+			removable:       s.get("removable", "no") == "yes",
+			snapshotBoot:    snapshotBoot,
+			snapshotEntries: snapshotEntries,
+		}
+	case "systemd-boot":
+		return systemdBoot{s, s.get("cmdline", "")}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown bootloader %s\n", name)
+		os.Exit(1)
+	}
+	return nil
+}
+
+// Returns the kernel parameters needed to find the root subvolume.
+func rootParams() string {
+	root, _ := findMount(readMountsOrDie(), "/")
+	params := fmt.Sprintf("root=UUID=%s rw", getUuidOrDie(root.device))
+	if subvol, ok := root.option("subvol"); ok {
+		params += " rootflags=subvol=" + strings.TrimPrefix(subvol, "/")
+	}
+	return params
+}
+
+// systemd-boot can only read the ESP, so the kernels, initramfs and
+// microcode images in /boot are copied to <esp>/arch and a pacman hook keeps
+// them in sync.  Snapshots are not added to the menu, their kernels would
+// all need copying too.  bootctl always installs the removable media
+// fallback, so removable= has no effect.
+type systemdBoot struct {
+	hostSettings settings
+	cmdline      string
+}
+
+func (sb systemdBoot) install() {
+	runOrDie("bootctl", "install", "--esp-path="+findEspOrDie(sb.hostSettings))
+}
+
+func (sb systemdBoot) update() {
+	esp := findEspOrDie(sb.hostSettings)
+	// Left by grub if the host used to boot with it
+	os.Remove(grubSnapshotScript)
+	os.Remove(grubSnapshotConfig)
+
+	kernels, _ := filepath.Glob("/boot/vmlinuz-*")
+	ucode, _ := filepath.Glob("/boot/*-ucode.img")
+
+	destDir := esp + "/arch"
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create %s!\n", destDir)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	initrds := ""
+	for _, img := range ucode {
+		copyFile(img, destDir+"/"+filepath.Base(img))
+		initrds += "initrd /arch/" + filepath.Base(img) + "\n"
+	}
+
+	params := rootParams()
+	defaultEntry := ""
+	for _, kernel := range kernels {
+		name := strings.TrimPrefix(filepath.Base(kernel), "vmlinuz-")
+		initramfs := "initramfs-" + name + ".img"
+		if _, err := os.Stat("/boot/" + initramfs); err != nil {
+			continue
+		}
+		copyFile(kernel, destDir+"/"+filepath.Base(kernel))
+		copyFile("/boot/"+initramfs, destDir+"/"+initramfs)
+
+		entry := "title Arch Linux (" + name + ")\n"
+		entry += "linux /arch/" + filepath.Base(kernel) + "\n"
+		entry += initrds
+		entry += "initrd /arch/" + initramfs + "\n"
+		entry += "options " + strings.TrimSpace(params+" "+sb.cmdline) + "\n"
+		writeFileOrDie(esp+"/loader/entries/arch-"+name+".conf", entry, 0644)
+
+		if defaultEntry == "" || name == "linux" {
+			defaultEntry = "arch-" + name + ".conf"
+		}
+	}
+
+	loader := "default " + defaultEntry + "\n"
+	loader += "timeout 3\n"
+	loader += "editor no\n"
+	writeFileOrDie(esp+"/loader/loader.conf", loader, 0644)
+
+	writeFileOrDie(bootloaderHook, `[Trigger]
+Operation = Install
+Operation = Upgrade
+Type = Path
+Target = usr/lib/modules/*/vmlinuz
+Target = usr/lib/initcpio/*
+Target = boot/*-ucode.img
+
+[Action]
+Description = Updating systemd-boot entries...
+When = PostTransaction
+Exec = `+sysconfCommand("boot")+`
+`, 0644)
+}
+
+func (sb systemdBoot) updateSnapshots() {}
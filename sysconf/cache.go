@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"overlay"
+)
+
+const offlinePacmanConf = "/tmp/sysconf-pacman.conf"
+const pacmanCache = "/var/cache/pacman/pkg"
+
+// Installed by setup's pacstrap rather than listed in pkgs
+var setupPkgs = []string{"base", "btrfs-progs", "linux", "linux-firmware", "git"}
+
+// Returns the extra pacman arguments for installing from a local repo or
+// package cache instead of the mirrors.
+func pacmanOptions(pkgRepo, pkgCache string) []string {
+	switch {
+	case pkgRepo != "":
+		writeFileOrDie(offlinePacmanConf, overlay.OfflinePacmanConf(pkgRepo), 0644)
+		return []string{"--config", offlinePacmanConf}
+	case pkgCache != "":
+		return []string{"--cachedir", pkgCache, "--cachedir", pacmanCache}
+	}
+	return nil
+}
+
+func readLinesOrDie(filename string) []string {
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open %s!\n", filename)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func outputOrDie(name string, args ...string) string {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = STDERR
+
+	out, err := cmd.Output()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to run command: %s %v!\n", name, args)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return string(out)
+}
+
+// Resolves pkgs and all their dependencies to package file names, as if
+// installing onto an empty system, using the current sync databases.
+func resolvePackagesOrDie(pkgs []string) []string {
+	dbPath, err := ioutil.TempDir("", "sysconf-cache-export")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to create temporary database!")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dbPath)
+	if err = os.Symlink("/var/lib/pacman/sync", dbPath+"/sync"); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to link sync databases!")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	args := append([]string{"-Sp", "--noconfirm", "--dbpath", dbPath, "--print-format", "%n-%v-%a"}, pkgs...)
+	return strings.Fields(outputOrDie("pacman", args...))
+}
+
+// Copies the packages listed in pkgFiles, and everything they depend on,
+// from the pacman cache to dest and creates a repo database for them, for
+// use with 'setup -pkgrepo' and 'sysconf -pkgrepo'.
+func cacheExport(dest string, pkgFiles []string) {
+	pkgs := append([]string{}, setupPkgs...)
+	for _, filename := range pkgFiles {
+		pkgs = append(pkgs, readLinesOrDie(filename)...)
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create %s!\n", dest)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	exported := []string{}
+	missing := []string{}
+	for _, name := range resolvePackagesOrDie(pkgs) {
+		matches, _ := filepath.Glob(pacmanCache + "/" + name + ".pkg.tar.*")
+		found := false
+		for _, match := range matches {
+			if strings.HasSuffix(match, ".sig") {
+				continue
+			}
+			copyFile(match, dest+"/"+filepath.Base(match))
+			if _, err := os.Stat(match + ".sig"); err == nil {
+				copyFile(match+".sig", dest+"/"+filepath.Base(match)+".sig")
+			}
+			exported = append(exported, dest+"/"+filepath.Base(match))
+			found = true
+			break
+		}
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(exported) != 0 {
+		runOrDie("repo-add", append([]string{dest + "/" + overlay.OfflineRepo + ".db.tar.gz"}, exported...)...)
+	}
+
+	fmt.Printf("Exported %d packages to %s\n", len(exported), dest)
+	if len(missing) != 0 {
+		fmt.Fprintf(os.Stderr, "%d packages are not in %s, download them with 'pacman -Sw' and export again:\n", len(missing), pacmanCache)
+		for _, name := range missing {
+			fmt.Fprintf(os.Stderr, "    %s\n", name)
+		}
+		os.Exit(1)
+	}
+}
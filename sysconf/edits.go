@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"overlay"
+)
+
+// A setting to change in a config file.  Files under a layer's edits
+// directory list them in the target file's own syntax:
+//
+//	[multilib]
+//	Include = /etc/pacman.d/mirrorlist
+//	MAKEFLAGS="-j$(nproc)"
+//	!Color
+//
+// Lines are written over the existing setting, uncommenting it if needed,
+// or added to the end of their section.  !Key comments a setting out.
+type edit struct {
+	section string
+	key     string
+	// The replacement line, empty to comment the setting out
+	line string
+}
+
+func isKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c == '-' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the key set by line, for lines like Key, Key = value, Key=value
+// and the same commented out, and whether it is commented.
+func lineKey(line string) (string, bool) {
+	body := strings.TrimSpace(line)
+	commented := strings.HasPrefix(body, "#")
+	body = strings.TrimSpace(strings.TrimPrefix(body, "#"))
+
+	end := strings.IndexAny(body, "= \t")
+	if end == -1 {
+		end = len(body)
+	}
+	key := body[:end]
+	rest := strings.TrimSpace(body[end:])
+	if !isKey(key) || (rest != "" && !strings.HasPrefix(rest, "=")) {
+		return "", commented
+	}
+	return key, commented
+}
+
+func lineSection(line string) (string, bool, bool) {
+	body := strings.TrimSpace(line)
+	commented := strings.HasPrefix(body, "#")
+	body = strings.TrimSpace(strings.TrimPrefix(body, "#"))
+	if !strings.HasPrefix(body, "[") || !strings.HasSuffix(body, "]") {
+		return "", false, false
+	}
+	return body[1 : len(body)-1], commented, true
+}
+
+// Returns the index after the last line of the setting starting at i,
+// following backslash continuations and multi-line shell arrays.
+func settingEnd(lines []string, i int) int {
+	depth := 0
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		depth += strings.Count(line, "(") - strings.Count(line, ")")
+		if depth <= 0 && !strings.HasSuffix(line, "\\") {
+			return i + 1
+		}
+	}
+	return len(lines)
+}
+
+func parseEditsOrDie(filename string) []edit {
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open %s!\n", filename)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	edits := []edit{}
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, _, ok := lineSection(line); ok {
+			section = name
+			continue
+		}
+		if strings.HasPrefix(line, "!") {
+			edits = append(edits, edit{section, strings.TrimSpace(line[1:]), ""})
+			continue
+		}
+		key, _ := lineKey(line)
+		if key == "" {
+			fmt.Fprintf(os.Stderr, "Invalid edit in %s: %s\n", filename, line)
+			os.Exit(1)
+		}
+		edits = append(edits, edit{section, key, line})
+	}
+	return edits
+}
+
+// Returns the range of lines in section, uncommenting its header if
+// needed, or -1 if there is no such section.  The empty section is the
+// whole file, for files without sections.
+func sectionRange(lines []string, section string) (int, int, bool) {
+	if section == "" {
+		return 0, len(lines), false
+	}
+
+	start := -1
+	uncommented := false
+	for i, line := range lines {
+		name, commented, ok := lineSection(line)
+		if ok && name == section && (start == -1 || !commented) {
+			start = i
+			uncommented = commented
+		}
+	}
+	if start == -1 {
+		return -1, -1, false
+	}
+
+	end := start + 1
+	for ; end < len(lines); end++ {
+		if _, _, ok := lineSection(lines[end]); ok {
+			break
+		}
+	}
+	return start + 1, end, uncommented
+}
+
+// Applies edits to content, returning the new content and a description of
+// each change made.
+func applyEdits(content string, edits []edit) (string, []string) {
+	lines := strings.Split(content, "\n")
+	report := []string{}
+
+	for _, e := range edits {
+		label := e.key
+		if e.section != "" {
+			label = "[" + e.section + "] " + e.key
+		}
+
+		start, end, uncomment := sectionRange(lines, e.section)
+		if start == -1 {
+			if e.line != "" {
+				lines = append(lines, "", "["+e.section+"]", e.line)
+				report = append(report, fmt.Sprintf("%s: added in new section", label))
+			}
+			continue
+		}
+		if uncomment {
+			lines[start-1] = "[" + e.section + "]"
+			report = append(report, fmt.Sprintf("[%s]: uncommented section", e.section))
+		}
+
+		found, foundCommented := -1, -1
+		for i := start; i < end; i++ {
+			key, commented := lineKey(lines[i])
+			if key != e.key {
+				continue
+			}
+			if !commented && found == -1 {
+				found = i
+			} else if commented && foundCommented == -1 {
+				foundCommented = i
+			}
+		}
+
+		switch {
+		case found != -1:
+			stop := settingEnd(lines, found)
+			old := strings.Join(lines[found:stop], "\n")
+			if e.line == "" {
+				for i := found; i < stop; i++ {
+					lines[i] = "#" + lines[i]
+				}
+				report = append(report, fmt.Sprintf("%s: commented out", label))
+			} else if old != e.line {
+				lines = append(lines[:found], append([]string{e.line}, lines[stop:]...)...)
+				report = append(report, fmt.Sprintf("%s: %q -> %q", label, old, e.line))
+			}
+		case e.line == "":
+			// Already commented out or not there
+		case foundCommented != -1:
+			report = append(report, fmt.Sprintf("%s: %q -> %q", label, lines[foundCommented], e.line))
+			lines[foundCommented] = e.line
+		default:
+			// After the last non blank line of the section
+			insert := end
+			for insert > start && strings.TrimSpace(lines[insert-1]) == "" {
+				insert--
+			}
+			lines = append(lines[:insert], append([]string{e.line}, lines[insert:]...)...)
+			report = append(report, fmt.Sprintf("%s: added %q", label, e.line))
+		}
+	}
+	return strings.Join(lines, "\n"), report
+}
+
+// Returns the file as shipped by the installed package that owns it, from
+// the pacman cache, so edits are applied on top of the package default
+// rather than piling up on the live file.
+func packageDefault(path string) (string, bool) {
+	owner, err := exec.Command("pacman", "-Qqo", path).Output()
+	if err != nil {
+		return "", false
+	}
+	installed, err := exec.Command("pacman", "-Q", strings.TrimSpace(string(owner))).Output()
+	if err != nil {
+		return "", false
+	}
+	fields := strings.Fields(string(installed))
+	if len(fields) != 2 {
+		return "", false
+	}
+
+	matches, _ := filepath.Glob(pacmanCache + "/" + fields[0] + "-" + fields[1] + "-*.pkg.tar.*")
+	for _, pkg := range matches {
+		if strings.HasSuffix(pkg, ".sig") {
+			continue
+		}
+		content, err := exec.Command("bsdtar", "-xOf", pkg, strings.TrimPrefix(path, "/")).Output()
+		if err == nil {
+			return string(content), true
+		}
+	}
+	return "", false
+}
+
+// Collects the edits from each layer's edits directory by target path, in
+// layer order so later layers win.
+func collectEditsOrDie(editDirs []string) map[string][]edit {
+	edits := map[string][]edit{}
+	for _, dir := range editDirs {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			target := strings.TrimPrefix(path, dir)
+			edits[target] = append(edits[target], parseEditsOrDie(path)...)
+			return nil
+		})
+	}
+	return edits
+}
+
+// Applies the edits from editDirs to the live files and returns a report of
+// what changed.  With dryRun nothing is written.
+func editFiles(editDirs []string, dryRun bool) []string {
+	edits := collectEditsOrDie(editDirs)
+	targets := []string{}
+	for target := range edits {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	report := []string{}
+	for _, target := range targets {
+		live, err := ioutil.ReadFile(target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read %s!\n", target)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		base, ok := packageDefault(target)
+		if !ok {
+			base = string(live)
+		}
+		updated, changes := applyEdits(base, edits[target])
+		if updated == string(live) {
+			continue
+		}
+		for _, change := range changes {
+			report = append(report, target+": "+change)
+		}
+		if !ok {
+			report = append(report, target+": package default not in cache, edited the live file")
+		}
+		if !dryRun {
+			info, _ := os.Stat(target)
+			writeFileOrDie(target, updated, info.Mode().Perm())
+		}
+	}
+	return report
+}
+
+// Prints a unified diff between two files.  diff exits non-zero when they
+// differ, so errors are ignored.
+func printDiff(fromLabel, from, toLabel, to string) {
+	cmd := exec.Command("diff", "-u", "--label", fromLabel, "--label", toLabel, from, to)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Run()
+}
+
+// Shows what applying the config would change, without changing anything.
+func diffCommand(files map[string]overlay.File, editDirs []string) {
+	for _, path := range overlay.SortedPaths(files) {
+		printDiff(path, path, files[path].Src, files[path].Src)
+	}
+	for _, change := range editFiles(editDirs, true) {
+		fmt.Println(change)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Snapshot entries are kept out of grub.cfg in their own file, which
+// 41_snapshots has grub.cfg source, so taking a snapshot on every pacman
+// transaction only rewrites that file instead of running grub-mkconfig.
+const grubSnapshotScript = "/etc/grub.d/41_snapshots"
+const grubSnapshotConfig = "/boot/grub/snapshots.cfg"
+
+func getUuidOrDie(device string) string {
+	out, err := exec.Command("lsblk", "-n", "-o", "UUID", device).Output()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to get uuid for %s!\n", device)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Returns the kernels in a snapshot's /boot, paired with their initramfs,
+// plus any microcode images, in the order grub-mkconfig would use them.
+func snapshotKernels(id string) ([]string, []string) {
+	boot := snapshotDir + "/" + id + "/boot"
+	kernels, _ := filepath.Glob(boot + "/vmlinuz-*")
+	ucode, _ := filepath.Glob(boot + "/*-ucode.img")
+	for i := range kernels {
+		kernels[i] = filepath.Base(kernels[i])
+	}
+	for i := range ucode {
+		ucode[i] = filepath.Base(ucode[i])
+	}
+	return kernels, ucode
+}
+
+// Returns the kernel parameters grub-mkconfig adds to every entry from
+// /etc/default/grub.
+func grubCmdline() string {
+	out, err := exec.Command("sh", "-c", `. /etc/default/grub && echo "$GRUB_CMDLINE_LINUX $GRUB_CMDLINE_LINUX_DEFAULT"`).Output()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to read kernel parameters from /etc/default/grub!")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func grubSnapshotEntry(uuid, id, subvol, flags, cmdline string) string {
+	kernels, ucode := snapshotKernels(id)
+	path := "/" + snapshotSubvol + "/" + subvol + "/boot/"
+
+	entries := ""
+	for _, kernel := range kernels {
+		initrds := []string{}
+		for _, img := range ucode {
+			initrds = append(initrds, path+img)
+		}
+		initramfs := "initramfs-" + strings.TrimPrefix(kernel, "vmlinuz-") + ".img"
+		if _, err := os.Stat(snapshotDir + "/" + id + "/boot/" + initramfs); err != nil {
+			continue
+		}
+		initrds = append(initrds, path+initramfs)
+
+		entries += fmt.Sprintf("\tmenuentry '%s (%s)' --class arch {\n", id, kernel)
+		entries += fmt.Sprintf("\t\tsearch --no-floppy --fs-uuid --set=root %s\n", uuid)
+		entries += fmt.Sprintf("\t\techo 'Loading snapshot %s...'\n", id)
+		entries += fmt.Sprintf("\t\tlinux %s%s %s\n", path, kernel, strings.TrimSpace(fmt.Sprintf("root=UUID=%s %s rootflags=subvol=%s/%s %s", uuid, flags, snapshotSubvol, subvol, cmdline)))
+		entries += fmt.Sprintf("\t\tinitrd %s\n", strings.Join(initrds, " "))
+		entries += "\t}\n"
+	}
+	return entries
+}
+
+// Writes the menu entries for the count most recent snapshots.  Snapshots
+// are read-only, so they are either booted read-only with a tmpfs overlay
+// on top ("overlay") or through a writable clone kept alongside the
+// snapshot ("clone").
+func writeGrubSnapshotConfig(mode string, count int) {
+	if !snapshotsAvailable() {
+		os.Remove(grubSnapshotConfig)
+		return
+	}
+
+	root, _ := findMount(readMountsOrDie(), "/")
+	uuid := getUuidOrDie(root.device)
+	cmdline := grubCmdline()
+
+	ids := listSnapshotsOrDie()
+	if len(ids) > count {
+		ids = ids[len(ids)-count:]
+	}
+
+	entries := ""
+	for i := len(ids) - 1; i >= 0; i-- {
+		id := ids[i]
+		switch mode {
+		case "overlay":
+			entries += grubSnapshotEntry(uuid, id, id, "ro systemd.volatile=overlay", cmdline)
+		case "clone":
+			if _, err := os.Stat(snapshotDir + "/" + id + snapshotCloneSuffix); err != nil {
+				runOrDie("btrfs", "subvolume", "snapshot", snapshotDir+"/"+id, snapshotDir+"/"+id+snapshotCloneSuffix)
+			}
+			entries += grubSnapshotEntry(uuid, id, id+snapshotCloneSuffix, "rw", cmdline)
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown snapshot boot mode %s\n", mode)
+			os.Exit(1)
+		}
+	}
+
+	config := "# Generated by sysconf from the snapshots in " + snapshotDir + " - do not edit!\n"
+	if entries != "" {
+		config += "submenu 'Arch Linux snapshots' {\n"
+		config += entries
+		config += "}\n"
+	}
+	writeFileOrDie(grubSnapshotConfig, config, 0644)
+}
+
+// The grub.d script only adds a source of the snapshot entries to grub.cfg,
+// so it never needs regenerating when they change.
+func writeGrubSnapshotScript() {
+	script := "#!/bin/sh\n"
+	script += "# Generated by sysconf - do not edit!\n"
+	script += "cat <<EOF\n"
+	script += "if [ -f \\${prefix}/" + filepath.Base(grubSnapshotConfig) + " ]; then\n"
+	script += "\tsource \\${prefix}/" + filepath.Base(grubSnapshotConfig) + "\n"
+	script += "fi\n"
+	script += "EOF\n"
+	writeFileOrDie(grubSnapshotScript, script, 0755)
+}
+
+type grub struct {
+	// Only used to find the ESP when installing
+	hostSettings settings
+	bootloaderId string
+	// Also install to the fallback path for firmware that forgets boot entries
+	removable       bool
+	snapshotBoot    string
+	snapshotEntries int
+}
+
+func (g grub) install() {
+	esp := findEspOrDie(g.hostSettings)
+	runOrDie("grub-install", "--target=x86_64-efi", "--efi-directory="+esp, "--bootloader-id="+g.bootloaderId)
+	if g.removable {
+		runOrDie("grub-install", "--target=x86_64-efi", "--efi-directory="+esp, "--removable")
+	}
+}
+
+func (g grub) update() {
+	writeGrubSnapshotScript()
+	g.updateSnapshots()
+	runOrDie("grub-mkconfig", "-o", "/boot/grub/grub.cfg")
+}
+
+func (g grub) updateSnapshots() {
+	writeGrubSnapshotConfig(g.snapshotBoot, g.snapshotEntries)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const localeGen = "/etc/locale.gen"
+const localeArchive = "/usr/lib/locale/locale-archive"
+
+// Uncomments the wanted locales in locale.gen and comments out any others,
+// leaving glibc's comments and list of locales alone.
+func selectLocales(content string, locales []string) string {
+	wanted := map[string]bool{}
+	for _, locale := range locales {
+		wanted[locale] = true
+	}
+
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		// Only lines like "#en_GB.UTF-8 UTF-8", not the comments above
+		// them, which have a space after the # even for the examples
+		entry := strings.TrimPrefix(line, "#")
+		if strings.HasPrefix(entry, " ") || strings.HasPrefix(entry, "\t") || len(strings.Fields(entry)) != 2 {
+			continue
+		}
+		entry = strings.TrimSpace(entry)
+		if wanted[entry] {
+			lines[i] = entry
+		} else if !strings.HasPrefix(line, "#") {
+			lines[i] = "#" + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the locales wanted by each layer.
+func readLocales(localeFiles []string) []string {
+	locales := []string{}
+	for _, filename := range localeFiles {
+		if _, err := os.Stat(filename); err == nil {
+			locales = append(locales, readLinesOrDie(filename)...)
+		}
+	}
+	return locales
+}
+
+// Enables the locales wanted by each layer in locale.gen, running
+// locale-gen only when the selection changed.  locale.gen is left alone
+// when no layer lists any locales.
+func configureLocales(localeFiles []string) {
+	locales := readLocales(localeFiles)
+	if len(locales) == 0 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(localeGen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read %s!\n", localeGen)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	updated := selectLocales(string(data), locales)
+	for _, locale := range locales {
+		if !strings.Contains("\n"+updated+"\n", "\n"+locale+"\n") {
+			fmt.Fprintf(os.Stderr, "Locale %s is not in %s!\n", locale, localeGen)
+			os.Exit(1)
+		}
+	}
+
+	_, err = os.Stat(localeArchive)
+	if updated == string(data) && err == nil {
+		return
+	}
+	writeFileOrDie(localeGen, updated, 0644)
+	runOrDie("locale-gen")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// The start of locale.gen as glibc ships it on Arch.
+const localeGenHeader = `# Configuration file for locale-gen
+#
+# lists of locales that are to be generated by the locale-gen command.
+#
+# Each line is of the form:
+#
+#     <locale> <charset>
+#
+#  where <locale> is one of the locales given in /usr/share/i18n/locales
+#  and <charset> is one of the character sets listed in /usr/share/i18n/charmaps
+#
+#  Examples:
+#  en_US ISO-8859-1
+#  en_US.UTF-8 UTF-8
+#  de_DE ISO-8859-1
+#  de_DE@euro ISO-8859-15
+#
+#  The locale-gen command will generate all the locales,
+#  placing them in /usr/lib/locale.
+#
+#  A list of supported locales is included in this file.
+#  Uncomment the ones you need.
+#
+
+`
+
+func TestSelectLocales(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries string
+		locales []string
+		want    string
+	}{
+		{
+			"enables wanted locales",
+			"#en_GB.UTF-8 UTF-8\n#en_US ISO-8859-1\n#en_US.UTF-8 UTF-8\n",
+			[]string{"en_GB.UTF-8 UTF-8", "en_US.UTF-8 UTF-8"},
+			"en_GB.UTF-8 UTF-8\n#en_US ISO-8859-1\nen_US.UTF-8 UTF-8\n",
+		},
+		{
+			"comments out other locales",
+			"en_GB.UTF-8 UTF-8\nde_DE.UTF-8 UTF-8\n",
+			[]string{"en_GB.UTF-8 UTF-8"},
+			"en_GB.UTF-8 UTF-8\n#de_DE.UTF-8 UTF-8\n",
+		},
+		{
+			"leaves enabled locales alone",
+			"#de_DE.UTF-8 UTF-8\nen_GB.UTF-8 UTF-8\n",
+			[]string{"en_GB.UTF-8 UTF-8"},
+			"#de_DE.UTF-8 UTF-8\nen_GB.UTF-8 UTF-8\n",
+		},
+		{
+			"no locales comments out everything",
+			"en_GB.UTF-8 UTF-8\n",
+			nil,
+			"#en_GB.UTF-8 UTF-8\n",
+		},
+	}
+
+	for _, test := range tests {
+		got := selectLocales(localeGenHeader+test.entries, test.locales)
+		if !strings.HasPrefix(got, localeGenHeader) {
+			t.Errorf("%s: changed the header:\n%s", test.name, got)
+			continue
+		}
+		if entries := strings.TrimPrefix(got, localeGenHeader); entries != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, entries, test.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"overlay"
+)
+
+// Suffixes pacman gives new upstream versions of modified config files,
+// and config files saved when their package was removed.
+var pacmanSuffixes = []string{".pacnew", ".pacsave"}
+
+// A live file that sysconf manages, either copied whole from source or
+// rendered from the upstream version by render.
+type managedFile struct {
+	target string
+	source string
+	render func(upstream string) string
+}
+
+// Returns the files sysconf manages.
+func managedFiles(copied map[string]overlay.File, editDirs []string, localeFiles []string) []managedFile {
+	files := []managedFile{}
+	for target, f := range copied {
+		files = append(files, managedFile{target, f.Src, nil})
+	}
+	for target, edits := range collectEditsOrDie(editDirs) {
+		edits := edits
+		render := func(upstream string) string {
+			content, _ := applyEdits(upstream, edits)
+			return content
+		}
+		files = append(files, managedFile{target, "", render})
+	}
+	if locales := readLocales(localeFiles); len(locales) != 0 {
+		files = append(files, managedFile{localeGen, "", func(upstream string) string {
+			return selectLocales(upstream, locales)
+		}})
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].target < files[j].target })
+	return files
+}
+
+// Returns the .pacnew and .pacsave files next to managed files.
+func findPacnew(files []managedFile) []string {
+	found := []string{}
+	for _, f := range files {
+		for _, suffix := range pacmanSuffixes {
+			if _, err := os.Stat(f.target + suffix); err == nil {
+				found = append(found, f.target+suffix)
+			}
+		}
+	}
+	return found
+}
+
+func warnPacnew(files []managedFile) {
+	found := findPacnew(files)
+	if len(found) == 0 {
+		return
+	}
+	fmt.Printf("Found %d .pacnew/.pacsave files for managed config, run 'sysconf pacnew' to merge them:\n", len(found))
+	for _, filename := range found {
+		fmt.Println("  " + filename)
+	}
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+func askChoice(prompt string, choices string) byte {
+	for {
+		fmt.Print(prompt)
+		line, err := stdin.ReadString('\n')
+		if err != nil {
+			fmt.Println()
+			os.Exit(1)
+		}
+		if answer := strings.TrimSpace(line); len(answer) == 1 && strings.Contains(choices, answer) {
+			return answer[0]
+		}
+	}
+}
+
+func writeTempOrDie(content string) string {
+	file, err := ioutil.TempFile("", "sysconf-")
+	if err == nil {
+		_, err = file.WriteString(content)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to write temporary file!")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return file.Name()
+}
+
+func removeOrDie(filename string) {
+	if err := os.Remove(filename); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to remove %s!\n", filename)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Opens files in $EDITOR, or vi when it is unset.
+func editOrDie(files ...string) {
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+	cmd := exec.Command(editor[0], append(editor[1:], files...)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to run %s!\n", editor[0])
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Shows the repo copy, live file and upstream version of a whole file, and
+// offers to edit the repo copy alongside the upstream version, then copy it
+// to the live file.  The repo copy usually carries local changes, so the
+// upstream version never replaces it wholesale.
+func mergeCopied(f managedFile, upstream string) {
+	fmt.Printf("Upstream changes (repo -> %s):\n", filepath.Base(upstream))
+	printDiff(f.source, f.source, upstream, upstream)
+	fmt.Println("Local changes (repo -> live):")
+	printDiff(f.source, f.source, f.target, f.target)
+
+	switch askChoice("[e]dit repo copy alongside it, [d]iscard, [s]kip? ", "eds") {
+	case 'e':
+		editOrDie(f.source, upstream)
+		fmt.Println("Changes to the live file (live -> repo):")
+		printDiff(f.target, f.target, f.source, f.source)
+		if askChoice("[u]pdate live file and remove the .pacnew, [s]kip? ", "us") == 'u' {
+			copyFile(f.source, f.target)
+			removeOrDie(upstream)
+		}
+	case 'd':
+		removeOrDie(upstream)
+	}
+}
+
+// Shows how the live file would change if the repo's edits were applied to
+// the upstream version instead, and offers to do it.
+func mergeRendered(f managedFile, upstream string) {
+	data, err := ioutil.ReadFile(upstream)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read %s!\n", upstream)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	rendered := f.render(string(data))
+	tmp := writeTempOrDie(rendered)
+	defer os.Remove(tmp)
+	fmt.Printf("Upstream changes with the repo's edits applied (live -> %s):\n", filepath.Base(upstream))
+	printDiff(f.target, f.target, upstream+" (edited)", tmp)
+
+	switch askChoice("[u]pdate live file, [d]iscard, [s]kip? ", "uds") {
+	case 'u':
+		info, _ := os.Stat(f.target)
+		writeFileOrDie(f.target, rendered, info.Mode().Perm())
+		removeOrDie(upstream)
+	case 'd':
+		removeOrDie(upstream)
+	}
+}
+
+// Shows what a .pacsave kept from the live file.  It is the old config
+// pacman moved aside, not a newer upstream version, so there is nothing to
+// take into the repo and it can only be discarded.
+func mergeSaved(f managedFile, saved string) {
+	fmt.Println("Saved changes (live -> .pacsave):")
+	printDiff(f.target, f.target, saved, saved)
+	if askChoice("[d]iscard, [s]kip? ", "ds") == 'd' {
+		removeOrDie(saved)
+	}
+}
+
+// Walks through each .pacnew and .pacsave of a managed file.
+func pacnewCommand(files []managedFile) {
+	for _, f := range files {
+		for _, suffix := range pacmanSuffixes {
+			upstream := f.target + suffix
+			if _, err := os.Stat(upstream); err != nil {
+				continue
+			}
+			fmt.Printf("== %s ==\n", upstream)
+			if suffix == ".pacsave" {
+				mergeSaved(f, upstream)
+			} else if f.render == nil {
+				mergeCopied(f, upstream)
+			} else {
+				mergeRendered(f, upstream)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Mode and ownership for a copied file, from lines in a layer's perms file:
+//
+//	/etc/sudoers.d/nopass 0440
+//	/etc/foo.conf 0640 root foo
+//
+// Files not listed are left 0644 and owned by root.
+type perm struct {
+	mode  os.FileMode
+	owner string
+	group string
+}
+
+func readPermsOrDie(permsFiles []string) map[string]perm {
+	perms := map[string]perm{}
+	for _, filename := range permsFiles {
+		if _, err := os.Stat(filename); err != nil {
+			continue
+		}
+		for _, line := range readLinesOrDie(filename) {
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 && len(fields) != 4 {
+				fmt.Fprintf(os.Stderr, "Invalid line in %s: %s\n", filename, line)
+				os.Exit(1)
+			}
+			mode, err := strconv.ParseUint(fields[1], 8, 32)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid mode in %s: %s\n", filename, line)
+				os.Exit(1)
+			}
+			p := perm{os.FileMode(mode), "root", "root"}
+			if len(fields) == 4 {
+				p.owner, p.group = fields[2], fields[3]
+			}
+			perms[fields[0]] = p
+		}
+	}
+	return perms
+}
+
+func applyPermsOrDie(perms map[string]perm) {
+	for path, p := range perms {
+		u, err := user.Lookup(p.owner)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unknown user %s for %s!\n", p.owner, path)
+			os.Exit(1)
+		}
+		g, err := user.LookupGroup(p.group)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unknown group %s for %s!\n", p.group, path)
+			os.Exit(1)
+		}
+		uid, _ := strconv.Atoi(u.Uid)
+		gid, _ := strconv.Atoi(g.Gid)
+
+		if err := os.Chown(path, uid, gid); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to set owner of %s!\n", path)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := os.Chmod(path, p.mode); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to set mode of %s!\n", path)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type settings map[string]string
+
+// Reads key=value lines into s, overriding any existing values.  Blank lines
+// and lines starting with # are ignored.  Missing files are skipped so that
+// a layer doesn't need a settings file.
+func (s settings) read(filename string) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open %s!\n", filename)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			fmt.Fprintf(os.Stderr, "Invalid setting in %s: %s\n", filename, line)
+			os.Exit(1)
+		}
+		s[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+}
+
+func (s settings) get(key, def string) string {
+	if value, ok := s[key]; ok {
+		return value
+	}
+	return def
+}
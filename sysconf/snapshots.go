@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const snapshotDir = "/mnt/snapshots"
+const snapshotSubvol = "@snapshots"
+const rootSubvol = "@"
+const snapshotCloneSuffix = ".rw"
+const snapshotHook = "/etc/pacman.d/hooks/00-sysconf-snapshot.hook"
+
+// Set while sysconf runs pacman so the pacman hook doesn't take a second
+// snapshot of the same state.
+const snapshotEnv = "SYSCONF_SNAPSHOT"
+
+type mount struct {
+	device     string
+	mountpoint string
+	fstype     string
+	options    []string
+}
+
+func (m mount) option(name string) (string, bool) {
+	for _, opt := range m.options {
+		if opt == name {
+			return "", true
+		}
+		if strings.HasPrefix(opt, name+"=") {
+			return strings.TrimPrefix(opt, name+"="), true
+		}
+	}
+	return "", false
+}
+
+func readMountsOrDie() []mount {
+	file, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to read mounts!")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	var mounts []mount
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		// Spaces in mountpoints are escaped as \040
+		mountpoint := strings.Replace(fields[1], "\\040", " ", -1)
+		mounts = append(mounts, mount{fields[0], mountpoint, fields[2], strings.Split(fields[3], ",")})
+	}
+	return mounts
+}
+
+func findMount(mounts []mount, mountpoint string) (mount, bool) {
+	// Later entries shadow earlier ones on the same mountpoint
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].mountpoint == mountpoint {
+			return mounts[i], true
+		}
+	}
+	return mount{}, false
+}
+
+// Snapshots are only taken when / is the @ subvolume and the @snapshots
+// subvolume is mounted where setup puts it.
+func snapshotsAvailable() bool {
+	mounts := readMountsOrDie()
+	root, ok := findMount(mounts, "/")
+	if !ok || root.fstype != "btrfs" {
+		return false
+	}
+	if subvol, _ := root.option("subvol"); strings.Trim(subvol, "/") != rootSubvol {
+		return false
+	}
+	snapshots, ok := findMount(mounts, snapshotDir)
+	if !ok || snapshots.fstype != "btrfs" {
+		return false
+	}
+	subvol, _ := snapshots.option("subvol")
+	return strings.Trim(subvol, "/") == snapshotSubvol
+}
+
+// Snapshot ids are <timestamp>-<reason> so that they sort by age.
+func snapshotReason(id string) string {
+	parts := strings.SplitN(id, "-", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[2]
+}
+
+func listSnapshotsOrDie() []string {
+	contents, err := ioutil.ReadDir(snapshotDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read %s!\n", snapshotDir)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var ids []string
+	for _, file := range contents {
+		if strings.HasSuffix(file.Name(), snapshotCloneSuffix) {
+			continue
+		}
+		if file.IsDir() && snapshotReason(file.Name()) != "" {
+			ids = append(ids, file.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func createSnapshot(reason string) string {
+	id := time.Now().Format("20060102-150405") + "-" + reason
+	runOrDie("btrfs", "subvolume", "snapshot", "-r", "/", snapshotDir+"/"+id)
+	return id
+}
+
+func deleteSnapshot(id string) {
+	// Remove the writable clone used for booting the snapshot first
+	clone := snapshotDir + "/" + id + snapshotCloneSuffix
+	if _, err := os.Stat(clone); err == nil {
+		runOrDie("btrfs", "subvolume", "delete", clone)
+	}
+	runOrDie("btrfs", "subvolume", "delete", snapshotDir+"/"+id)
+}
+
+// Keeps the most recent keep snapshots for each reason, so frequent pacman
+// upgrades can't push out the snapshots taken by sysconf.
+func pruneSnapshots(keep int) {
+	byReason := map[string][]string{}
+	for _, id := range listSnapshotsOrDie() {
+		reason := snapshotReason(id)
+		byReason[reason] = append(byReason[reason], id)
+	}
+
+	for _, ids := range byReason {
+		for len(ids) > keep {
+			deleteSnapshot(ids[0])
+			ids = ids[1:]
+		}
+	}
+}
+
+// Rolls back by moving the current @ into @snapshots and replacing it with
+// a writable snapshot of id.  @ is also made the default subvolume so the
+// system comes up on it even without an explicit subvol= option.
+func rollbackSnapshot(id string) {
+	if _, err := os.Stat(snapshotDir + "/" + id); err != nil {
+		fmt.Fprintf(os.Stderr, "Unknown snapshot %s\n", id)
+		os.Exit(1)
+	}
+
+	root, _ := findMount(readMountsOrDie(), "/")
+	topLevel, err := ioutil.TempDir("", "sysconf-rollback")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to create mountpoint for rollback!")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	runOrDie("mount", "-o", "subvolid=5", root.device, topLevel)
+
+	previous := time.Now().Format("20060102-150405") + "-rollback"
+	if err = os.Rename(topLevel+"/"+rootSubvol, topLevel+"/"+snapshotSubvol+"/"+previous); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to move current root subvolume!")
+		fmt.Fprintln(os.Stderr, err)
+		runOrDie("umount", topLevel)
+		os.Exit(1)
+	}
+	runOrDie("btrfs", "subvolume", "snapshot", topLevel+"/"+snapshotSubvol+"/"+id, topLevel+"/"+rootSubvol)
+	runOrDie("btrfs", "subvolume", "set-default", topLevel+"/"+rootSubvol)
+
+	runOrDie("umount", topLevel)
+	os.Remove(topLevel)
+
+	fmt.Printf("Rolled back to %s, previous root saved as %s.\n", id, previous)
+	fmt.Println("Reboot to use the restored system, then run sysconf to update the boot menu.")
+}
+
+// The hook aborts the transaction when the snapshot can't be taken, but
+// not when the binary it was written with has since moved.
+func writeSnapshotHook() {
+	exePath := strings.SplitN(selfCommand, " ", 2)[0]
+	writeFileOrDie(snapshotHook, `[Trigger]
+Operation = Install
+Operation = Upgrade
+Operation = Remove
+Type = Package
+Target = *
+
+[Action]
+Description = Creating btrfs snapshot...
+When = PreTransaction
+Exec = /bin/sh -c 'if [ -x `+exePath+` ]; then exec `+sysconfCommand("snapshots", "create", "pacman")+`; else echo "Warning: `+exePath+` is missing, skipping snapshot."; fi'
+AbortOnFail
+`, 0644)
+}
+
+// Takes a snapshot for the pacman hook.  Runs before any of the repo's
+// config is read, so a mistake in it can't block the transaction that
+// might fix it.  Only failing to take the snapshot is an error, pruning and
+// updating the boot menu is left to a separate run whose failure is just a
+// warning.
+func createSnapshotCommand(args []string) {
+	if len(args) != 1 || strings.Contains(args[0], "/") {
+		snapshotsUsage()
+	}
+	if !snapshotsAvailable() {
+		fmt.Printf("%s is not mounted, skipping snapshot.\n", snapshotDir)
+		return
+	}
+	if taken := os.Getenv(snapshotEnv); taken != "" {
+		fmt.Printf("Snapshot %s already taken by sysconf.\n", taken)
+		return
+	}
+	fmt.Printf("Created snapshot %s\n", createSnapshot(args[0]))
+
+	exePath, err := os.Executable()
+	if err == nil {
+		// The same flags, with prune instead of create
+		cmd := exec.Command(exePath, append(os.Args[1:len(os.Args)-len(args)-2], "snapshots", "prune")...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: unable to prune snapshots and update the boot menu, run 'sysconf snapshots prune' once fixed.")
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func snapshotsUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: sysconf snapshots list|create <reason>|prune|rollback <id>")
+	os.Exit(1)
+}
+
+func snapshotsCommand(args []string, keep int, loader bootloader) {
+	if len(args) == 0 {
+		snapshotsUsage()
+	}
+
+	if !snapshotsAvailable() {
+		fmt.Fprintf(os.Stderr, "Snapshots unavailable: / must be the %s subvolume and %s mounted on %s\n", rootSubvol, snapshotSubvol, snapshotDir)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		for _, id := range listSnapshotsOrDie() {
+			fmt.Println(id)
+		}
+	case "prune":
+		pruneSnapshots(keep)
+		loader.updateSnapshots()
+	case "rollback":
+		if len(args) != 2 {
+			snapshotsUsage()
+		}
+		rollbackSnapshot(args[1])
+	default:
+		snapshotsUsage()
+	}
+}
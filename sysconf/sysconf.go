@@ -9,11 +9,24 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+
+	"overlay"
 )
 
 var STDOUT io.Writer
 var STDERR io.Writer
 
+// Set by the Makefile so setup can check the binary matches the source.
+var sourceHash string
+
+// How pacman hooks call back into sysconf, set in main.
+var selfCommand string
+
+func sysconfCommand(args ...string) string {
+	return selfCommand + " " + strings.Join(args, " ")
+}
+
 func copyFile(src string, dest string) {
 	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
@@ -44,23 +57,24 @@ func copyFile(src string, dest string) {
 	}
 }
 
-func copyDir(src string, dest string) {
-	contents, err := ioutil.ReadDir(src)
-	if err != nil {
+func writeFileOrDie(filename, content string, perms os.FileMode) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create path for %s!\n", filename)
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	if err := ioutil.WriteFile(filename, []byte(content), perms); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write %s!\n", filename)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
-	for _, file := range contents {
-		srcFilename := src + "/" + file.Name()
-		destFilename := dest + "/" + file.Name()
-
-		if file.IsDir() {
-			os.MkdirAll(destFilename, 0755)
-			copyDir(srcFilename, destFilename)
-		} else if file.Mode().IsRegular() {
-			copyFile(srcFilename, destFilename)
-		}
+// Copies the winning copy of each file in the overlay into place.
+func copyOverlay(files map[string]overlay.File) {
+	for _, path := range overlay.SortedPaths(files) {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		copyFile(files[path].Src, path)
 	}
 }
 
@@ -117,20 +131,50 @@ func enableServices(filename string) {
 	}
 }
 
-func main() {
-	if os.Getuid() != 0 {
-		fmt.Fprintln(os.Stderr, "Must be run as root user!")
-		os.Exit(1)
-	}
+// Files are copied into place, so only regular files are taken from sysfiles.
+var overlayOptions = overlay.Options{RegularOnly: true}
 
+func main() {
 	var system string
 	var withOutput bool
 	var installgrub bool
+	var installBootloader bool
+	var keep int
+	var snapshotBoot string
+	var snapshotEntries int
+	var printSourceHash bool
+	var pkgRepo string
+	var pkgCache string
+	var extraLayers string
 
 	flag.StringVar(&system, "system", "", "Optional. The hostname of the system to configure.")
 	flag.BoolVar(&withOutput, "output", false, "Optional. Display the output of the commands run.")
-	flag.BoolVar(&installgrub, "installgrub", false, "Optional.  Install grub bootloader.")
+	flag.BoolVar(&installgrub, "installgrub", false, "Deprecated. Same as -installbootloader.")
+	flag.BoolVar(&installBootloader, "installbootloader", false, "Optional. Install the bootloader set in the host settings.")
+	flag.IntVar(&keep, "keep", 10, "Optional. Number of snapshots to keep for each reason.")
+	flag.StringVar(&snapshotBoot, "snapshotboot", "overlay", "Optional. How snapshots are booted from the boot menu: overlay or clone.")
+	flag.IntVar(&snapshotEntries, "snapshotentries", 5, "Optional. Number of recent snapshots to add to the boot menu.")
+	flag.BoolVar(&printSourceHash, "sourcehash", false, "Optional. Print the hash of the source this was built from and exit.")
+	flag.StringVar(&pkgRepo, "pkgrepo", "", "Optional. Install packages from a local repo made by cache-export instead of the mirrors.")
+	flag.StringVar(&pkgCache, "pkgcache", "", "Optional. Use packages from this cache directory before downloading them.")
+	flag.StringVar(&extraLayers, "layers", "", "Optional. Comma separated layers to apply between shared and the host instead of the host's roles.")
 	flag.Parse()
+
+	if printSourceHash {
+		fmt.Println(sourceHash)
+		return
+	}
+
+	if os.Getuid() != 0 {
+		fmt.Fprintln(os.Stderr, "Must be run as root user!")
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) == "snapshots" && flag.Arg(1) == "create" {
+		createSnapshotCommand(flag.Args()[2:])
+		return
+	}
+
 	if system == "" {
 		var err error
 		if system, err = os.Hostname(); err != nil {
@@ -163,24 +207,111 @@ func main() {
 
 	systemDir := srcPath + "/" + system
 	sharedDir := srcPath + "/shared"
-	// Need to copy before running pacman to ensure that pacman.conf is there
-	copyDir(systemDir+"/files", "/")
-	copyDir(sharedDir+"/files", "/")
+	selfCommand = exePath + " -system " + system
+
+	extra, err := overlay.Extra(filepath.Dir(srcPath), system, extraLayers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to find the layers for %s!\n", system)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if extraLayers != "" {
+		selfCommand += " -layers " + extraLayers
+	}
+	layers := overlay.Layers(srcPath, system, extra)
+
+	hostSettings := settings{}
+	for _, filename := range overlay.Paths(layers, "settings") {
+		hostSettings.read(filename)
+	}
+	loader := newBootloader(hostSettings, snapshotBoot, snapshotEntries)
+
+	files, warnings := overlay.Resolve(layers, "files", overlayOptions)
+	editDirs := overlay.Paths(layers, "edits")
+	localeFiles := overlay.Paths(layers, "locales")
+	permsFiles := overlay.Paths(layers, "perms")
+	pkgFiles := overlay.Paths(layers, "pkgs")
+
+	switch flag.Arg(0) {
+	case "":
+	case "snapshots":
+		snapshotsCommand(flag.Args()[1:], keep, loader)
+		return
+	case "boot":
+		loader.update()
+		return
+	case "diff":
+		diffCommand(files, editDirs)
+		return
+	case "pacnew":
+		pacnewCommand(managedFiles(files, editDirs, localeFiles))
+		return
+	case "layers":
+		overlay.List(layers, files, warnings, overlayOptions)
+		return
+	case "adopt":
+		path, host := overlay.AdoptArgsOrDie("sysconf", flag.Args()[1:])
+		if host {
+			adoptCommand(path, systemDir)
+		} else {
+			adoptCommand(path, sharedDir)
+		}
+		return
+	case "cache-export":
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "Usage: sysconf cache-export <dir>")
+			os.Exit(1)
+		}
+		dest, err := filepath.Abs(flag.Arg(1))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cacheExport(dest, pkgFiles)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if snapshotsAvailable() {
+		id := createSnapshot("sysconf")
+		os.Setenv(snapshotEnv, id)
+		pruneSnapshots(keep)
+	}
+	writeSnapshotHook()
+
+	// Need to copy and edit before running pacman to ensure that pacman.conf is there
+	overlay.PrintWarnings(warnings)
+	copyOverlay(files)
+	applyPermsOrDie(readPermsOrDie(permsFiles))
+	for _, change := range editFiles(editDirs, false) {
+		fmt.Println(change)
+	}
 
 	// Ensure keys are up to date
 	runOrDie("pacman-key", "--populate", "archlinux")
 
-	runWithStdinOrDie(systemDir+"/pkgs", "pacman", "-Sy", "--needed", "--noconfirm", "-")
-	runWithStdinOrDie(sharedDir+"/pkgs", "pacman", "-S", "--needed", "--noconfirm", "-")
+	pacmanOpts := pacmanOptions(pkgRepo, pkgCache)
+	for i, filename := range pkgFiles {
+		sync := "-S"
+		if i == 0 {
+			sync = "-Sy"
+		}
+		runWithStdinOrDie(filename, "pacman", append(pacmanOpts, sync, "--needed", "--noconfirm", "-")...)
+	}
 
-	runOrDie("locale-gen")
+	configureLocales(localeFiles)
 
-	enableServices(systemDir + "/services")
-	enableServices(sharedDir + "/services")
+	for _, filename := range overlay.Paths(layers, "services") {
+		enableServices(filename)
+	}
 
-	if installgrub {
-		runOrDie("grub-install", "--target=x86_64-efi", "--efi-directory=/boot/efi", "--bootloader-id=Arch")
+	if installgrub || installBootloader {
+		loader.install()
 	}
-	runOrDie("grub-mkconfig", "-o", "/boot/grub/grub.cfg")
+	loader.update()
 
+	warnPacnew(managedFiles(files, editDirs, localeFiles))
 }